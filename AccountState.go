@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path"
+)
+
+// AccountState holds the balance and the nonce of every account at the top of the blockchain. It
+// is updated block by block and guarded by the mutex of the Blockchain it belongs to
+type AccountState struct {
+	balances map[string]int
+	nonces   map[string]int
+}
+
+// newAccountState returns an empty AccountState
+func newAccountState() *AccountState {
+	return &AccountState{balances: make(map[string]int), nonces: make(map[string]int)}
+}
+
+// balance returns the balance of a certain PublicKey
+func (s *AccountState) balance(key string) int {
+	return s.balances[key]
+}
+
+// nonce returns the nonce the next transaction of a certain PublicKey must have, which is the
+// number of transactions it already sent
+func (s *AccountState) nonce(key string) int {
+	return s.nonces[key]
+}
+
+// connectBlock applies the transactions of a block to the state
+func (s *AccountState) connectBlock(b *Block) {
+	for _, t := range b.transactions {
+		s.connectTransaction(t)
+	}
+}
+
+// connectTransaction applies a single transaction to the state. The sender pays the amount and the
+// fee and uses up its nonce, and a coinbase only credits its recipient
+func (s *AccountState) connectTransaction(t *Transaction) {
+	if !t.isCoinbase() {
+		s.balances[t.senderKey] -= t.amount + t.fee
+		s.nonces[t.senderKey]++
+	}
+	s.balances[t.recipientKey] += t.amount
+}
+
+// disconnectBlock reverts the changes connectBlock made for a block
+func (s *AccountState) disconnectBlock(b *Block) {
+	for i := len(b.transactions) - 1; i >= 0; i-- {
+		t := b.transactions[i]
+		s.balances[t.recipientKey] -= t.amount
+		if !t.isCoinbase() {
+			s.balances[t.senderKey] += t.amount + t.fee
+			s.nonces[t.senderKey]--
+		}
+	}
+	s.clean(b)
+}
+
+// clean removes the empty accounts a block touched
+func (s *AccountState) clean(b *Block) {
+	for _, t := range b.transactions {
+		for _, key := range []string{t.senderKey, t.recipientKey} {
+			if s.balances[key] == 0 {
+				delete(s.balances, key)
+			}
+			if s.nonces[key] == 0 {
+				delete(s.nonces, key)
+			}
+		}
+	}
+}
+
+// copy returns a deep copy of the state
+func (s *AccountState) copy() *AccountState {
+	c := newAccountState()
+	for key, balance := range s.balances {
+		c.balances[key] = balance
+	}
+	for key, nonce := range s.nonces {
+		c.nonces[key] = nonce
+	}
+	return c
+}
+
+// equals compares two AccountStates and returns an error describing the first difference. An
+// account with a zero balance or nonce is the same as a missing one, since only disconnectBlock
+// removes the empty accounts
+func (s *AccountState) equals(s2 *AccountState) error {
+	if err := compareAccounts("balance", s.balances, s2.balances); err != nil {
+		return err
+	}
+	return compareAccounts("nonce", s.nonces, s2.nonces)
+}
+
+// compareAccounts returns an error describing the first account whose value differs between two
+// maps, where a missing account counts as zero
+func compareAccounts(name string, m1, m2 map[string]int) error {
+	for key, value := range m2 {
+		if m1[key] != value {
+			return fmt.Errorf("%s of %s is %d instead of %d", name, key, m1[key], value)
+		}
+	}
+	for key, value := range m1 {
+		if m2[key] != value {
+			return fmt.Errorf("%s of %s is %d instead of %d", name, key, value, m2[key])
+		}
+	}
+	return nil
+}
+
+// buildAccountState builds an AccountState from the blocks of a store, from the origin block up
+func buildAccountState(store BlockStore) (*AccountState, error) {
+	s := newAccountState()
+	err := store.Iterate(0, func(b *Block) error {
+		s.connectBlock(b)
+		return nil
+	})
+	return s, err
+}
+
+// GetBalance returns the balance of a certain PublicKey at the top of the blockchain
+func (bc *Blockchain) GetBalance(key string) int {
+	bc.mutex.Lock()
+	balance := bc.state.balance(key)
+	bc.mutex.Unlock()
+	return balance
+}
+
+// GetNonce returns the nonce the next transaction of a certain PublicKey must have
+func (bc *Blockchain) GetNonce(key string) int {
+	bc.mutex.Lock()
+	nonce := bc.state.nonce(key)
+	bc.mutex.Unlock()
+	return nonce
+}
+
+// GetAccountState returns a copy of the account state at the top of the blockchain
+func (bc *Blockchain) GetAccountState() *AccountState {
+	bc.mutex.Lock()
+	state := bc.state.copy()
+	bc.mutex.Unlock()
+	return state
+}
+
+// CheckState rebuilds the account state from the blocks and compares it to the maintained one.
+// If they differ, the rebuilt state replaces it and an error describing the difference is returned.
+// A pruned blockchain can't rebuild its state and is not checked
+func (bc *Blockchain) CheckState() error {
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+	if bc.store.Pruned() > 0 {
+		return nil
+	}
+	rebuilt, err := buildAccountState(bc.store)
+	if err != nil {
+		return fmt.Errorf("failed to rebuild the account state: %s", err)
+	}
+	if err := bc.state.equals(rebuilt); err != nil {
+		bc.state = rebuilt
+		return fmt.Errorf("the account state was inconsistent and was rebuilt: %s", err)
+	}
+	return nil
+}
+
+// stateAt returns a copy of the account state as it was at the received length of the
+// blockchain. The caller must hold the blockchain's mutex
+func (bc *Blockchain) stateAt(length int) (*AccountState, error) {
+	s := bc.state.copy()
+	for i := len(bc.headers) - 1; i >= length; i-- {
+		b, err := bc.store.Get(i)
+		if err != nil {
+			return nil, err
+		}
+		s.disconnectBlock(b)
+	}
+	return s, nil
+}
+
+// genesisState returns the account state of the origin block alone
+func (bc *Blockchain) genesisState() *AccountState {
+	s := newAccountState()
+	s.connectBlock(bc.network.genesis)
+	return s
+}
+
+// statePath returns the path of the saved account state in a data directory
+func statePath(dataDir string) string {
+	return path.Join(dataDir, "state.json")
+}
+
+// readAccountState reads the account state saved in a data directory and the header of the block
+// it is the state at
+func readAccountState(dataDir string) (*AccountState, *BlockHeader, error) {
+	data, err := ioutil.ReadFile(statePath(dataDir))
+	if err != nil {
+		return nil, nil, err
+	}
+	var saved JSONSavedState
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, nil, err
+	}
+	if saved.State == nil {
+		return nil, nil, errors.New("no account state")
+	}
+	return saved.State, &BlockHeader{index: saved.Height, hash: saved.Tip}, nil
+}
+
+// save writes the account state, as the state at the block of a header, to a data directory
+func (s *AccountState) save(dataDir string, tip *BlockHeader) error {
+	data, err := json.Marshal(JSONSavedState{Height: tip.index, Tip: tip.hash, State: s})
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(statePath(dataDir), data)
+}
@@ -0,0 +1,35 @@
+package main
+
+import "testing"
+
+func TestAccountStateEqualsAfterReorg(t *testing.T) {
+	// X receives coins and spends all of them, so the rebuilt state keeps X with a zero balance
+	b1 := &Block{index: 1, transactions: []*Transaction{{senderKey: "M", recipientKey: "X", amount: 5}}}
+	b2 := &Block{index: 2, transactions: []*Transaction{{senderKey: "X", recipientKey: "Y", amount: 5}}}
+	// the block switched away from touches X again, so disconnecting it removes X
+	a3 := &Block{index: 3, transactions: []*Transaction{{senderKey: "M", recipientKey: "X", amount: 1}}}
+	b3 := &Block{index: 3, transactions: []*Transaction{{senderKey: "M", recipientKey: "Y", amount: 2}}}
+
+	reorged := newAccountState()
+	for _, b := range []*Block{b1, b2, a3} {
+		reorged.connectBlock(b)
+	}
+	reorged.disconnectBlock(a3)
+	reorged.connectBlock(b3)
+
+	rebuilt := newAccountState()
+	for _, b := range []*Block{b1, b2, b3} {
+		rebuilt.connectBlock(b)
+	}
+	if err := reorged.equals(rebuilt); err != nil {
+		t.Fatal(err)
+	}
+	if err := rebuilt.equals(reorged); err != nil {
+		t.Fatal(err)
+	}
+
+	rebuilt.connectBlock(a3)
+	if err := reorged.equals(rebuilt); err == nil {
+		t.Fatal("different states are equal")
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+const (
+	// EntryReward is an AddressEntry of a coinbase transaction
+	EntryReward = "reward"
+	// EntryCredit is an AddressEntry of a received transaction
+	EntryCredit = "credit"
+	// EntryDebit is an AddressEntry of a sent transaction
+	EntryDebit = "debit"
+
+	// MaxHistoryPageSize is the maximum number of entries in a page of an address history
+	MaxHistoryPageSize = 100
+)
+
+// AddressEntry is a single change to the balance of an address
+type AddressEntry struct {
+	Kind       string `json:"kind"`
+	TxHash     string `json:"txHash"`
+	Amount     int    `json:"amount"`
+	BlockIndex int    `json:"blockIndex"`
+	Timestamp  int64  `json:"timestamp"`
+}
+
+// AddressIndex maps every public key to the changes to its balance, ordered by block height. It is
+// guarded by the mutex of the Blockchain it belongs to
+type AddressIndex struct {
+	entries map[string][]AddressEntry
+}
+
+// newAddressIndex returns an empty AddressIndex
+func newAddressIndex() *AddressIndex {
+	return &AddressIndex{entries: make(map[string][]AddressEntry)}
+}
+
+// add appends an entry to the history of key
+func (idx *AddressIndex) add(key string, e AddressEntry) {
+	idx.entries[key] = append(idx.entries[key], e)
+}
+
+// connectBlock adds the transactions of a block to the index
+func (idx *AddressIndex) connectBlock(b *Block) {
+	for _, t := range b.transactions {
+		if t.isCoinbase() {
+			idx.add(t.recipientKey, AddressEntry{Kind: EntryReward, TxHash: t.hash, Amount: t.amount, BlockIndex: b.index, Timestamp: b.timestamp})
+			continue
+		}
+		idx.add(t.senderKey, AddressEntry{Kind: EntryDebit, TxHash: t.hash, Amount: -(t.amount + t.fee), BlockIndex: b.index, Timestamp: b.timestamp})
+		idx.add(t.recipientKey, AddressEntry{Kind: EntryCredit, TxHash: t.hash, Amount: t.amount, BlockIndex: b.index, Timestamp: b.timestamp})
+	}
+}
+
+// disconnectBlock removes the entries of a block, which must be the top block of the index
+func (idx *AddressIndex) disconnectBlock(b *Block) {
+	keys := []string{}
+	for _, t := range b.transactions {
+		keys = append(keys, t.senderKey, t.recipientKey)
+	}
+	for _, key := range keys {
+		entries := idx.entries[key]
+		for len(entries) > 0 && entries[len(entries)-1].BlockIndex >= b.index {
+			entries = entries[:len(entries)-1]
+		}
+		if len(entries) == 0 {
+			delete(idx.entries, key)
+		} else {
+			idx.entries[key] = entries
+		}
+	}
+}
+
+// history returns a page of the entries of key, newest first, and the total number of entries
+func (idx *AddressIndex) history(key string, page, pageSize int) ([]AddressEntry, int) {
+	entries := idx.entries[key]
+	total := len(entries)
+	if pageSize <= 0 || pageSize > MaxHistoryPageSize {
+		pageSize = MaxHistoryPageSize
+	}
+	if page < 0 {
+		page = 0
+	}
+	result := []AddressEntry{}
+	if total == 0 || page > (total-1)/pageSize { // past the last page, and page*pageSize may overflow
+		return result, total
+	}
+	for i := total - 1 - page*pageSize; i >= 0 && len(result) < pageSize; i-- {
+		result = append(result, entries[i])
+	}
+	return result, total
+}
+
+// GetAddressHistory returns a page of the changes to the balance of a public key, newest first,
+// and the total number of changes
+func (bc *Blockchain) GetAddressHistory(key string, page, pageSize int) ([]AddressEntry, int) {
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+	return bc.addrIndex.history(key, page, pageSize)
+}
@@ -1,9 +1,6 @@
 package main
 
 import (
-	"crypto/sha256"
-	"encoding/hex"
-	"fmt"
 	"math/big"
 )
 
@@ -14,30 +11,38 @@ type Block struct {
 	miner        string
 	transactions []*Transaction
 	prevHash     string
+	merkleRoot   string
+	difficulty   int
 	nuance       *big.Int
 	hash         string
 }
 
 // updateHash updates the block hash
 func (b *Block) updateHash() {
-	hash := sha256.New()
-	data := fmt.Sprintf("%d%d%s%s%s%d", b.index, b.timestamp, b.miner,
-		transactionSliceToHashString(b.transactions), b.prevHash, b.nuance)
-	hash.Write([]byte(data))
-	hashChecksum := hash.Sum(nil)
-	b.hash = hex.EncodeToString(hashChecksum)
+	b.hash = b.Header().computeHash()
 }
 
 // verifyPOW verifies if the Proof-of-Work is valid in the block
 func (b *Block) verifyPOW() bool {
-	hashBytes := []byte(b.hash)
-	leadingZeros := 5 // leadingZeros is the number of leading zeros required for the POW
-	for i := 0; i < leadingZeros; i++ {
-		if hashBytes[i] != 48 { // 48 is the value of the char '0'
-			return false
-		}
+	return b.Header().verifyPOW()
+}
+
+// chainWork returns the cumulative work of the received blocks
+func chainWork(blocks []*Block) *big.Int {
+	sum := big.NewInt(0)
+	for _, b := range blocks {
+		sum.Add(sum, b.Header().work())
+	}
+	return sum
+}
+
+// size returns the number of bytes the block takes when encoded
+func (b *Block) size() int {
+	data, err := b.ToBytes()
+	if err != nil {
+		return 0
 	}
-	return true
+	return len(data)
 }
 
 // ToBytes converts a Block to an array of bytes
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"math/big"
+
+	ec "github.com/IBentu/CryptoCurrency/EClib"
+)
+
+// BlockHeader holds the fields of a Block that its hash commits to, without the transactions
+type BlockHeader struct {
+	index      int
+	timestamp  int64
+	miner      string
+	prevHash   string
+	merkleRoot string
+	difficulty int
+	nuance     *big.Int
+	hash       string
+}
+
+// Header returns the header of the block
+func (b *Block) Header() *BlockHeader {
+	return &BlockHeader{
+		index:      b.index,
+		timestamp:  b.timestamp,
+		miner:      b.miner,
+		prevHash:   b.prevHash,
+		merkleRoot: b.merkleRoot,
+		difficulty: b.difficulty,
+		nuance:     b.nuance,
+		hash:       b.hash,
+	}
+}
+
+// computeHash returns the hash of the canonical encoding of the header's fields. The encoding holds
+// the magnitude of the nuance only, so a header with a negative nuance is invalid
+func (h *BlockHeader) computeHash() string {
+	var nuance []byte
+	if h.nuance != nil {
+		nuance = h.nuance.Bytes()
+	}
+	sum := sha256.Sum256(ec.ECEncodeBlockHeader(h.index, h.timestamp, h.miner, h.prevHash, h.merkleRoot, h.difficulty, nuance))
+	return hex.EncodeToString(sum[:])
+}
+
+// verifyPOW verifies if the Proof-of-Work is valid in the header, meaning the hash has at least
+// as many leading zero bits as the difficulty
+func (h *BlockHeader) verifyPOW() bool {
+	return leadingZeroBits(h.hash) >= h.difficulty
+}
+
+// work returns the expected number of hashes it took to mine the block, derived from its hash target
+func (h *BlockHeader) work() *big.Int {
+	if h.index == 0 {
+		return big.NewInt(0)
+	}
+	return new(big.Int).Lsh(big.NewInt(1), uint(h.difficulty))
+}
+
+// headersWork returns the cumulative work of the received headers
+func headersWork(headers []*BlockHeader) *big.Int {
+	sum := big.NewInt(0)
+	for _, h := range headers {
+		sum.Add(sum, h.work())
+	}
+	return sum
+}
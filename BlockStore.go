@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+)
+
+const (
+	// StoreDir is the block store that keeps every block in its own file, <block index>.block
+	StoreDir = "dir"
+	// StoreLog is the block store that keeps the blocks in a single append-only log file
+	StoreLog = "log"
+)
+
+const (
+
+	// LoadChunkSize is the number of blocks read from the block store and validated at once
+	LoadChunkSize = 500
+)
+
+var (
+	// ErrPruned is an error for a block whose body was pruned, so only its header is kept
+	ErrPruned = errors.New("the block was pruned, only its header is kept")
+)
+
+// BlockStore keeps the blocks of the main chain by height, so the blockchain only has to hold
+// their headers in memory. A store isn't safe for concurrent use, and is guarded by the mutex
+// of the Blockchain it belongs to
+type BlockStore interface {
+	// Get returns the block at a height
+	Get(height int) (*Block, error)
+	// GetByHash returns the block with a hash
+	GetByHash(hash string) (*Block, error)
+	// GetHeader returns the header of the block at a height, even if its body was pruned
+	GetHeader(height int) (*BlockHeader, error)
+	// Iterate calls fn for every block from a height up to the tip, until fn returns an error. It
+	// returns ErrPruned if the height is below Pruned
+	Iterate(from int, fn func(*Block) error) error
+	// Tip returns the height and the hash of the top block, or -1 if the store is empty
+	Tip() (int, string)
+	// Pruned returns the height of the lowest block whose body is kept
+	Pruned() int
+	// Prune drops the bodies of the blocks below a height and keeps their headers
+	Prune(height int) error
+	// Batch starts a set of changes that are applied together by its Commit
+	Batch() BlockBatch
+	// Close releases the files of the store
+	Close() error
+}
+
+// BlockBatch is a set of changes to a BlockStore
+type BlockBatch interface {
+	// Put stores a block on top of the store, at its index
+	Put(b *Block)
+	// Truncate removes the blocks from a height up
+	Truncate(height int)
+	// Commit applies the changes of the batch
+	Commit() error
+}
+
+// batchOp is a single change of a BlockBatch. A nil block truncates the store at height
+type batchOp struct {
+	block  *Block
+	height int
+}
+
+// openBlockStore opens the block store of the received kind in a data directory
+func openBlockStore(kind, dataDir string) (BlockStore, error) {
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		return nil, err
+	}
+	switch kind {
+	case "", StoreDir:
+		return openDirStore(path.Join(dataDir, "Blockchain"))
+	case StoreLog:
+		return openLogStore(path.Join(dataDir, "blocks.log"))
+	}
+	return nil, fmt.Errorf("unknown block store %q", kind)
+}
+
+// iterateChunks calls fn for consecutive chunks of up to size blocks of a store, from a height up
+func iterateChunks(store BlockStore, from, size int, fn func([]*Block) error) error {
+	chunk := make([]*Block, 0, size)
+	err := store.Iterate(from, func(b *Block) error {
+		chunk = append(chunk, b)
+		if len(chunk) < size {
+			return nil
+		}
+		err := fn(chunk)
+		chunk = make([]*Block, 0, size)
+		return err
+	})
+	if err != nil || len(chunk) == 0 {
+		return err
+	}
+	return fn(chunk)
+}
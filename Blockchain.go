@@ -3,20 +3,63 @@ package main
 import (
 	"errors"
 	"fmt"
-	"io/ioutil"
+	"math/big"
 	"os"
-	"path"
-	"strconv"
 	"sync"
 )
 
 // Blockchain is the database for all the blocks
 type Blockchain struct {
-	blocks   []*Block
-	mutex    *sync.Mutex
-	updating bool
+	store       BlockStore
+	headers     []*BlockHeader
+	orphans     []*OrphanedBranch
+	state       *AccountState
+	txIndex     *TxIndex
+	addrIndex   *AddressIndex
+	retarget    *Retarget
+	policy      *MonetaryPolicy
+	consensus   *ConsensusParams
+	network     *Network
+	checkpoints *Checkpoints
+	assumeValid string
+	pruneDepth  int
+	dataDir     string
+	mutex       *sync.Mutex
+	updating    bool
 }
 
+// OrphanedBranch is a part of the blockchain that was replaced by a branch with more work
+type OrphanedBranch struct {
+	ForkIndex  int      `json:"forkIndex"`
+	ReplacedAt int64    `json:"replacedAt"`
+	Blocks     []*Block `json:"blocks"`
+}
+
+// ReorgEvent describes a replacement of the top of the blockchain by another branch
+type ReorgEvent struct {
+	Depth        int
+	ForkIndex    int
+	OldTip       string
+	NewTip       string
+	Disconnected []*Block
+	Connected    int
+}
+
+const (
+
+	// MaxOrphanedBranches is the number of orphaned branches the blockchain keeps for inspection
+	MaxOrphanedBranches = 10
+)
+
+var (
+	// ErrBlockNotFound is an error for a block that isn't in the blockchain
+	ErrBlockNotFound = errors.New("block not found")
+	// ErrNotEnoughWork is an error for a branch that doesn't have more work than the blocks it replaces
+	ErrNotEnoughWork = errors.New("the branch doesn't have more work than the blockchain")
+	// ErrNotOnTop is an error for a block that doesn't continue the top block of the blockchain
+	ErrNotOnTop = errors.New("the block doesn't continue the top of the blockchain")
+)
+
 // SetUpdating changes the update status of the blockchain
 func (bc *Blockchain) SetUpdating(status bool) {
 	bc.mutex.Lock()
@@ -33,91 +76,189 @@ func (bc *Blockchain) IsUpdating() bool {
 }
 
 // init initiates the blockchain at node startup
-func (bc *Blockchain) init() {
-	bc.blocks = []*Block{}
+func (bc *Blockchain) init(network *Network, config *JSONConfig) {
+	bc.network = network
+	checkpoints, err := newCheckpoints(network.checkpoints, config.Checkpoints)
+	checkError(err)
+	bc.checkpoints = checkpoints
+	bc.assumeValid = config.AssumeValid
+	checkError(checkPruneDepth(config.Prune))
+	bc.pruneDepth = config.Prune
+	bc.dataDir = network.dataDir(config.DataDir)
+	bc.headers = []*BlockHeader{}
+	bc.orphans = []*OrphanedBranch{}
+	bc.state = newAccountState()
+	bc.txIndex = newTxIndex()
+	bc.addrIndex = newAddressIndex()
+	if idx, err := readTxIndex(bc.dataDir); err == nil {
+		bc.txIndex = idx
+	}
+	bc.retarget = newRetarget(network.difficulty)
+	bc.policy = newMonetaryPolicy(network.policy)
+	bc.consensus = newConsensusParams(network.consensus)
 	bc.mutex = &sync.Mutex{}
 	bc.updating = false
-	fmt.Println(bc.readBlockchain())
+	store, err := openBlockStore(config.Store, bc.dataDir)
+	checkError(err)
+	fmt.Println(bc.readBlockchain(store))
 }
 
-// saveBlockchain saves the blockchain in /Config/Blockchain/ in the format of <block index>.block
+// saveBlockchain saves the tx index and the account state of the blockchain, and prunes it if it
+// is pruned. The blocks are stored as they are connected
 func (bc *Blockchain) saveBlockchain() error {
-	currDir, err := os.Getwd()
-	if err != nil {
-		return err
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+	if err := bc.txIndex.save(bc.dataDir); err != nil {
+		return fmt.Errorf("failed to save the tx index: %s", err)
 	}
-	errList := ""
-	if bc.IsUpdating() {
-		return errors.New("cannot save blockchain while it's in use")
+	if err := bc.state.save(bc.dataDir, bc.headers[len(bc.headers)-1]); err != nil {
+		return fmt.Errorf("failed to save the account state: %s", err)
 	}
+	if err := bc.prune(); err != nil {
+		return fmt.Errorf("failed to prune the blockchain: %s", err)
+	}
+	return nil
+}
+
+// Close closes the block store of the blockchain
+func (bc *Blockchain) Close() error {
 	bc.mutex.Lock()
-	for i := 1; i < len(bc.blocks); i++ {
-		dir := path.Join(currDir, fmt.Sprintf("Config/Blockchain/%d.block", i))
-		data, err := bc.blocks[i].MarshalJSON()
-		if err != nil {
-			errList += strconv.Itoa(i) + " "
-			continue
+	defer bc.mutex.Unlock()
+	return bc.store.Close()
+}
+
+// readBlockchain loads the blockchain from a block store, validating every stored block, and
+// removes the blocks that are invalid from the store. The origin block is the network's, and a
+// stored origin block must match it. An account state saved at a stored block vouches for the
+// transactions up to that block, so only the headers and the structure of those blocks are
+// validated, and the blocks below it may be pruned
+func (bc *Blockchain) readBlockchain(store BlockStore) error {
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+	genesis := bc.network.genesis
+	if top, _ := store.Tip(); top < 0 {
+		batch := store.Batch()
+		batch.Put(genesis)
+		if err := batch.Commit(); err != nil {
+			return err
+		}
+	} else if h, err := store.GetHeader(0); err != nil || h.hash != genesis.hash {
+		fmt.Printf("%s holds the origin block of another network than %s\n", bc.dataDir, bc.network.name)
+		os.Exit(1)
+	}
+	bc.store = store
+	bc.headers = []*BlockHeader{genesis.Header()}
+	bc.addrIndex = newAddressIndex()
+	bc.addrIndex.connectBlock(genesis)
+	_, tip := store.Tip()
+	rebuild := bc.txIndex.Tip != tip
+	if rebuild {
+		bc.txIndex = newTxIndex()
+		bc.txIndex.connectBlock(genesis)
+	}
+	trusted := 0
+	state := bc.genesisState()
+	if saved, at, err := readAccountState(bc.dataDir); err == nil {
+		if h, err := store.GetHeader(at.index); err == nil && h.hash == at.hash {
+			trusted = at.index
+			state = saved
+		}
+	}
+	pruned := store.Pruned()
+	if pruned > trusted+1 {
+		fmt.Printf("The blocks of %s below index %d are pruned and no saved account state starts above them\n", bc.dataDir, pruned)
+		os.Exit(1)
+	}
+	// the stored blocks are a chain, so the assume-valid block is looked up in the store once and the
+	// signatures of its ancestors are trusted as they are loaded
+	assumed := -1
+	if b, err := store.GetByHash(bc.assumeValid); bc.assumeValid != "" && err == nil {
+		assumed = b.index
+	}
+	now := GetCurrentMillis()
+	for i := 1; i < pruned; i++ {
+		h, err := store.GetHeader(i)
+		if err == nil {
+			err = bc.validateHeader(h, bc.headers, now)
 		}
-		err = ioutil.WriteFile(dir, data, 0644)
 		if err != nil {
-			errList += strconv.Itoa(i) + " "
-			continue
+			fmt.Printf("The pruned blocks of %s are invalid, remove it to download the blockchain again: %s\n", bc.dataDir, err)
+			os.Exit(1)
 		}
+		bc.headers = append(bc.headers, h)
 	}
-	bc.mutex.Unlock()
-	if len(errList) > 2 {
-		return fmt.Errorf("failed to save blocks at indexes: %s", errList)
+	load := func(blocks []*Block, state *AccountState) {
+		for _, b := range blocks {
+			bc.headers = append(bc.headers, b.Header())
+			if state != nil {
+				state.connectBlock(b)
+			}
+			bc.addrIndex.connectBlock(b)
+			if rebuild {
+				bc.txIndex.connectBlock(b)
+			}
+		}
 	}
-	return nil
-}
-
-// readBlockchain reads the blockchain from /Config/Blockchain/ and adds it to the node
-func (bc *Blockchain) readBlockchain() error {
-	currDir, err := os.Getwd()
-	if err != nil {
+	from := pruned
+	if from < 1 {
+		from = 1
+	}
+	verr := iterateChunks(store, from, LoadChunkSize, func(chunk []*Block) error {
+		split := 0
+		for split < len(chunk) && chunk[split].index <= trusted {
+			split++
+		}
+		valid, err := bc.validateStructures(len(bc.headers), chunk[:split])
+		load(chunk[:valid], nil)
+		if err != nil {
+			return err
+		}
+		valid, err = bc.validateBlocks(len(bc.headers), state.copy(), chunk[split:], assumed)
+		load(chunk[split:split+valid], state)
 		return err
+	})
+	if verr == nil {
+		bc.state = state
+		if len(bc.headers) == 1 {
+			return errors.New("loaded the origin of the blockchain")
+		}
+		if pruned > 0 {
+			return fmt.Errorf("loaded blockchain from the origin to index %d, pruned below index %d", len(bc.headers)-1, pruned)
+		}
+		return fmt.Errorf("loaded blockchain from the origin to index %d", len(bc.headers)-1)
 	}
-	blocks := make([]*Block, 0)
-	bc.mutex.Lock()
-	dir := path.Join(currDir, "Config/Blockchain/0.block")
-	data, err := ioutil.ReadFile(dir)
-	if err != nil {
-		fmt.Println(errors.New("Error reading the origin block"))
+	if len(bc.headers) <= trusted && pruned > 0 {
+		fmt.Printf("The pruned blocks of %s are invalid, remove it to download the blockchain again: %s\n", bc.dataDir, verr)
 		os.Exit(1)
 	}
-	b := &Block{}
-	err = b.UnmarshalJSON(data)
-	if err != nil {
-		fmt.Println(errors.New("Error reading the origin block"))
-		os.Exit(1)
+	batch := store.Batch()
+	batch.Truncate(len(bc.headers))
+	if err := batch.Commit(); err != nil {
+		return fmt.Errorf("failed to remove the blocks from index %d: %s", len(bc.headers), err)
 	}
-	blocks = append(blocks, b)
-	i := 1
-	for ; ; i++ {
-		dir = path.Join(currDir, fmt.Sprintf("Config/Blockchain/%d.block", i))
-		data, err := ioutil.ReadFile(dir)
+	if !rebuild {
+		idx, err := buildTxIndex(store)
 		if err != nil {
-			break
+			return err
 		}
-		b := &Block{}
-		err = b.UnmarshalJSON(data)
+		bc.txIndex = idx
+	}
+	// the saved state is above the refused blocks, so it is rebuilt from the stored ones
+	if len(bc.headers) <= trusted {
+		rebuilt, err := buildAccountState(store)
 		if err != nil {
-			break
+			return err
 		}
-		blocks = append(blocks, b)
-	}
-	bc.blocks = blocks
-	bc.mutex.Unlock()
-	if i == 1 {
-		return errors.New("loaded the origin of the blockchain")
+		state = rebuilt
 	}
-	return fmt.Errorf("loaded blockchain from the origin to index %d", i-1)
+	bc.state = state
+	return fmt.Errorf("loaded blockchain from the origin to index %d, refused the rest: %s", len(bc.headers)-1, verr)
 }
 
 // GetLatestIndex returns the indexes of the latests block
 func (bc *Blockchain) GetLatestIndex() int {
 	bc.mutex.Lock()
-	length := len(bc.blocks) - 1
+	length := len(bc.headers) - 1
 	bc.mutex.Unlock()
 	return length
 }
@@ -125,125 +266,346 @@ func (bc *Blockchain) GetLatestIndex() int {
 // GetLatestHash returns the indexes of the latests block
 func (bc *Blockchain) GetLatestHash() string {
 	bc.mutex.Lock()
-	hash := bc.blocks[len(bc.blocks)-1].hash
+	hash := bc.headers[len(bc.headers)-1].hash
 	bc.mutex.Unlock()
 	return hash
 }
 
+// TotalWork returns the cumulative work of the blockchain
+func (bc *Blockchain) TotalWork() *big.Int {
+	bc.mutex.Lock()
+	work := headersWork(bc.headers)
+	bc.mutex.Unlock()
+	return work
+}
+
+// NextDifficulty returns the difficulty the next block of the blockchain must have
+func (bc *Blockchain) NextDifficulty() int {
+	bc.mutex.Lock()
+	difficulty := bc.retarget.nextDifficulty(bc.headers)
+	bc.mutex.Unlock()
+	return difficulty
+}
+
 // GetHash returns the hash of the block in the specified index
 func (bc *Blockchain) GetHash(index int) (string, error) {
 	if index > bc.GetLatestIndex() || index < 0 {
 		return "", errors.New("Index Out of Bounds")
 	}
 	bc.mutex.Lock()
-	hash := bc.blocks[index].hash
+	hash := bc.headers[index].hash
 	bc.mutex.Unlock()
 	return hash, nil
 }
 
-//AddBlock adds a block to the blockchain
-func (bc *Blockchain) AddBlock(b *Block) {
+//AddBlock stores a block on top of the blockchain and adds it to the blockchain. It returns
+// ErrNotOnTop if the block doesn't continue the top block, which is checked under the same lock
+func (bc *Blockchain) AddBlock(b *Block) error {
 	bc.mutex.Lock()
-	bc.blocks = append(bc.blocks, b)
-	bc.mutex.Unlock()
+	defer bc.mutex.Unlock()
+	if top := bc.headers[len(bc.headers)-1]; b.index != top.index+1 || b.prevHash != top.hash {
+		return ErrNotOnTop
+	}
+	batch := bc.store.Batch()
+	batch.Put(b)
+	if err := batch.Commit(); err != nil {
+		return err
+	}
+	bc.connectBlock(b)
+	return nil
+}
+
+// connectBlock appends a stored block to the blockchain and updates the account state and the
+// indexes. The caller must hold the blockchain's mutex
+func (bc *Blockchain) connectBlock(b *Block) {
+	bc.headers = append(bc.headers, b.Header())
+	bc.state.connectBlock(b)
+	bc.txIndex.connectBlock(b)
+	bc.addrIndex.connectBlock(b)
+}
+
+// disconnectTop removes the top block of the blockchain, which is received, and reverts the
+// account state and the indexes. The caller must hold the blockchain's mutex
+func (bc *Blockchain) disconnectTop(b *Block) {
+	bc.addrIndex.disconnectBlock(b)
+	bc.txIndex.disconnectBlock(b)
+	bc.state.disconnectBlock(b)
+	bc.headers = bc.headers[:len(bc.headers)-1]
 }
 
 // AddBlocks adds blocks to the blockchain
-func (bc *Blockchain) AddBlocks(blocks []*Block) {
+func (bc *Blockchain) AddBlocks(blocks []*Block) error {
 	for _, b := range blocks {
-		bc.AddBlock(b)
+		if err := bc.AddBlock(b); err != nil {
+			return err
+		}
 	}
-}
-
-// IsBlockValid validates a block is valid hash-wise and index-wise
-func (bc *Blockchain) IsBlockValid(b Block) bool {
-	bc.mutex.Lock()
-	valid := bc.blocks[len(bc.blocks)-1].index == b.index && bc.blocks[len(bc.blocks)-1].hash == b.prevHash
-	bc.mutex.Unlock()
-	return valid
+	return nil
 }
 
 // DoesTransactionExist checks if a given transaction already happened in the blockchain
 func (bc *Blockchain) DoesTransactionExist(t *Transaction) bool {
-	blocks := bc.getCopy()
-	for _, block := range blocks {
-		for _, transaction := range block.transactions {
-			if transaction.hash == t.hash {
-				return true
-			}
-		}
-	}
-	return false
+	return bc.IsConfirmed(t.hash)
 }
 
-// getCopy returns a copy of the blockchain
-func (bc *Blockchain) getCopy() []Block {
-	copy := []Block{}
+// IsConfirmed checks if a transaction hash is in the blockchain
+func (bc *Blockchain) IsConfirmed(hash string) bool {
 	bc.mutex.Lock()
-	for _, block := range bc.blocks {
-		copy = append(copy, *block)
-	}
+	_, ok := bc.txIndex.Locations[hash]
 	bc.mutex.Unlock()
-	return copy
+	return ok
 }
 
 // Length returns the current length of the blockchain
 func (bc *Blockchain) Length() int {
 	bc.mutex.Lock()
-	length := len(bc.blocks)
+	length := len(bc.headers)
 	bc.mutex.Unlock()
 	return length
 }
 
 // GetBlock returns a block in the specified index
-func (bc *Blockchain) GetBlock(index int) Block {
+func (bc *Blockchain) GetBlock(index int) (Block, error) {
 	bc.mutex.Lock()
-	b := bc.blocks[index]
-	bc.mutex.Unlock()
-	return *b
+	defer bc.mutex.Unlock()
+	b, err := bc.store.Get(index)
+	if err != nil {
+		return Block{}, err
+	}
+	return *b, nil
 }
 
-// GetBlocksFromTop returns the number of blocks from the top of the blockchain from the received number
-func (bc *Blockchain) GetBlocksFromTop(num int) []*Block {
-	index := bc.GetLatestIndex() - num
+// GetBlockByHash returns the block with the specified hash
+func (bc *Blockchain) GetBlockByHash(hash string) (Block, error) {
 	bc.mutex.Lock()
-	blocks := bc.blocks[index:]
-	bc.mutex.Unlock()
+	defer bc.mutex.Unlock()
+	b, err := bc.store.GetByHash(hash)
+	if err != nil {
+		return Block{}, err
+	}
+	return *b, nil
+}
+
+// HasHeader checks if the blockchain has the received header at its index
+func (bc *Blockchain) HasHeader(h *BlockHeader) bool {
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+	return h.index >= 0 && h.index < len(bc.headers) && bc.headers[h.index].hash == h.hash
+}
+
+// GetHeaders returns up to count headers from the specified index up
+func (bc *Blockchain) GetHeaders(index, count int) []*BlockHeader {
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+	if index < 0 || index >= len(bc.headers) || count <= 0 {
+		return []*BlockHeader{}
+	}
+	last := index + count
+	if last > len(bc.headers) {
+		last = len(bc.headers)
+	}
+	headers := make([]*BlockHeader, last-index)
+	copy(headers, bc.headers[index:last])
+	return headers
+}
+
+// readBlocks reads the blocks from index first up to index last (not included) from the store. It
+// stops at the first block that can't be read. The caller must hold the blockchain's mutex
+func (bc *Blockchain) readBlocks(first, last int) []*Block {
+	if first < 0 {
+		first = 0
+	}
+	if last > len(bc.headers) {
+		last = len(bc.headers)
+	}
+	blocks := make([]*Block, 0)
+	for i := first; i < last; i++ {
+		b, err := bc.store.Get(i)
+		if err != nil {
+			break
+		}
+		blocks = append(blocks, b)
+	}
 	return blocks
 }
 
-// GetBlocksFromIndex returns blocks from the specified index until ten block before it (or the genesis block)
-func (bc *Blockchain) GetBlocksFromIndex(index int) []*Block {
-	firstIndex := index - 10
-	if firstIndex < 0 {
-		firstIndex = 0
+// GetBlocks returns up to count blocks from the specified index up
+func (bc *Blockchain) GetBlocks(index, count int) []*Block {
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+	if index < 0 || count <= 0 {
+		return []*Block{}
 	}
+	return bc.readBlocks(index, index+count)
+}
+
+// GetBlocksFromTop returns the number of blocks from the top of the blockchain from the received number
+func (bc *Blockchain) GetBlocksFromTop(num int) []*Block {
 	bc.mutex.Lock()
-	blocks := bc.blocks[firstIndex:index]
-	bc.mutex.Unlock()
-	return blocks
+	defer bc.mutex.Unlock()
+	return bc.readBlocks(len(bc.headers)-1-num, len(bc.headers))
 }
 
-// CompareBlockchains compares the current blockchain top block's hash the recieved blocks's bottom block's hash
-// and returns true if they are the same
-func (bc *Blockchain) CompareBlockchains(blocks []*Block) bool {
-	hash, err := bc.GetHash(blocks[0].index)
+// GetBlocksFromIndex returns blocks from the specified index until ten block before it (or the genesis block).
+// It returns ErrPruned if any of them was pruned
+func (bc *Blockchain) GetBlocksFromIndex(index int) ([]*Block, error) {
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+	if index-10 < bc.store.Pruned() && index > 0 {
+		return nil, ErrPruned
+	}
+	return bc.readBlocks(index-10, index), nil
+}
+
+// SwitchBranch switches the blockchain to a branch of headers that starts at a block of the
+// blockchain, if the branch has more work than the blocks it replaces. The blocks of the branch are
+// requested with fetch a chunk at a time, and every chunk is validated, stored and connected before
+// the next one is requested, so the branch is never held in memory. The blockchain's mutex is held
+// from the checks to the switch, and if a chunk can't be fetched or is invalid the replaced blocks
+// are connected back. It keeps the replaced blocks as an orphaned branch and returns a ReorgEvent
+// describing the switch
+func (bc *Blockchain) SwitchBranch(headers []*BlockHeader, fetch func(index, count int) ([]*Block, error)) (*ReorgEvent, error) {
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+	index := headers[0].index
+	if index < 0 || index >= len(bc.headers) || bc.headers[index].hash != headers[0].hash {
+		return nil, errors.New("the branch doesn't start at a block of the blockchain")
+	}
+	fork := index
+	for i := 0; fork < len(bc.headers) && i < len(headers) && bc.headers[fork].hash == headers[i].hash; i++ {
+		fork++
+	}
+	headers = headers[fork-index:]
+	if len(headers) == 0 || headersWork(headers).Cmp(headersWork(bc.headers[fork:])) <= 0 {
+		return nil, ErrNotEnoughWork
+	}
+	if fork < len(bc.headers) && fork <= bc.checkpoints.last(len(bc.headers)-1) {
+		return nil, ErrBelowCheckpoint
+	}
+	if fork < len(bc.headers) && fork < bc.store.Pruned() {
+		return nil, ErrPruned
+	}
+	disconnected := make([]*Block, 0, len(bc.headers)-fork)
+	err := bc.store.Iterate(fork, func(b *Block) error {
+		disconnected = append(disconnected, b)
+		return nil
+	})
 	if err != nil {
-		return false
+		return nil, err
+	}
+	event := &ReorgEvent{
+		ForkIndex:    fork,
+		OldTip:       bc.headers[len(bc.headers)-1].hash,
+		NewTip:       headers[len(headers)-1].hash,
+		Depth:        len(disconnected),
+		Disconnected: disconnected,
+		Connected:    len(headers),
+	}
+	// a pruned blockchain is loaded from its saved account state, so the state is saved at the fork
+	// before the blocks it was saved at are removed
+	if event.Depth > 0 && bc.store.Pruned() > 0 {
+		state, err := bc.stateAt(fork)
+		if err != nil {
+			return nil, err
+		}
+		if err := state.save(bc.dataDir, bc.headers[fork-1]); err != nil {
+			return nil, err
+		}
+	}
+	assumed := bc.assumedValid(bc.headers[:fork], headers)
+	batch := bc.store.Batch()
+	batch.Truncate(fork)
+	if err := batch.Commit(); err != nil {
+		return nil, err
 	}
-	if hash == blocks[0].hash {
-		return true
+	for i := len(disconnected) - 1; i >= 0; i-- {
+		bc.disconnectTop(disconnected[i])
 	}
-	return false
+	if err := bc.connectBranch(headers, assumed, fetch); err != nil {
+		if rerr := bc.restoreBlocks(fork, disconnected); rerr != nil {
+			return nil, fmt.Errorf("%s, and failed to restore the replaced blocks: %s", err, rerr)
+		}
+		return nil, err
+	}
+	if event.Depth > 0 {
+		bc.orphans = append(bc.orphans, &OrphanedBranch{ForkIndex: fork, ReplacedAt: GetCurrentMillis(), Blocks: event.Disconnected})
+		if len(bc.orphans) > MaxOrphanedBranches {
+			bc.orphans = bc.orphans[1:]
+		}
+	}
+	return event, nil
 }
 
-// ReplaceBlocks replaces a part of the blockchain with the recieved blocks
-func (bc *Blockchain) ReplaceBlocks(blocks []*Block) {
+// connectBranch requests the blocks of a branch of headers that continues the blockchain with fetch,
+// up to LoadChunkSize blocks at a time, and validates, stores and connects every chunk. The caller
+// must hold the blockchain's mutex
+func (bc *Blockchain) connectBranch(headers []*BlockHeader, assumed int, fetch func(index, count int) ([]*Block, error)) error {
+	for next := 0; next < len(headers); {
+		count := len(headers) - next
+		if count > LoadChunkSize {
+			count = LoadChunkSize
+		}
+		chunk, err := fetch(headers[next].index, count)
+		if err != nil {
+			return err
+		}
+		if len(chunk) == 0 || len(chunk) > count {
+			return errors.New("received an unexpected number of blocks")
+		}
+		for i, b := range chunk {
+			if b.hash != headers[next+i].hash {
+				return errors.New("received blocks that don't match the headers of the branch")
+			}
+		}
+		if _, err := bc.validateBlocks(len(bc.headers), bc.state.copy(), chunk, assumed); err != nil {
+			return err
+		}
+		batch := bc.store.Batch()
+		for _, b := range chunk {
+			batch.Put(b)
+		}
+		if err := batch.Commit(); err != nil {
+			return err
+		}
+		for _, b := range chunk {
+			bc.connectBlock(b)
+		}
+		next += len(chunk)
+	}
+	return nil
+}
+
+// restoreBlocks disconnects the blocks of the blockchain from index fork and connects the received
+// blocks, which were disconnected from there, back. The caller must hold the blockchain's mutex
+func (bc *Blockchain) restoreBlocks(fork int, blocks []*Block) error {
+	for len(bc.headers) > fork {
+		b, err := bc.store.Get(len(bc.headers) - 1)
+		if err != nil {
+			return err
+		}
+		bc.disconnectTop(b)
+	}
+	batch := bc.store.Batch()
+	batch.Truncate(fork)
+	for _, b := range blocks {
+		batch.Put(b)
+	}
+	if err := batch.Commit(); err != nil {
+		return err
+	}
+	for _, b := range blocks {
+		bc.connectBlock(b)
+	}
+	return nil
+}
+
+// GetOrphanedBranches returns the branches that were replaced by branches with more work
+func (bc *Blockchain) GetOrphanedBranches() []*OrphanedBranch {
 	bc.mutex.Lock()
-	defer bc.mutex.Unlock()
-	index := blocks[0].index
-	bc.blocks = bc.blocks[:index]
-	bc.blocks = append(bc.blocks, blocks...)
+	orphans := make([]*OrphanedBranch, len(bc.orphans))
+	copy(orphans, bc.orphans)
+	bc.mutex.Unlock()
+	return orphans
 }
 
 // HashString returns a string of the hashes of the blockchain
@@ -251,8 +613,8 @@ func (bc *Blockchain) HashString() string {
 	str := ""
 	bc.mutex.Lock()
 	defer bc.mutex.Unlock()
-	for _, b := range bc.blocks {
-		str += b.hash + "\n"
+	for _, h := range bc.headers {
+		str += h.hash + "\n"
 	}
 	return str
 }
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	ec "github.com/IBentu/CryptoCurrency/EClib"
+)
+
+const (
+
+	// APITimeout is the time (in seconds) a command waits for the local API of the node
+	APITimeout = 600
+)
+
+// commandGroups are the subcommands of the command line by group, as <group> <subcommand> [flags]
+var commandGroups = map[string]map[string]func([]string) error{
+	"node": {
+		"run": runNode,
+	},
+	"wallet": {
+		"new":     runWalletNew,
+		"balance": runWalletBalance,
+		"send":    runWalletSend,
+	},
+	"chain": {
+		"info":   runChainInfo,
+		"verify": runChainVerify,
+		"export": runExport,
+		"import": runImport,
+	},
+	"peers": {
+		"list":   runPeersList,
+		"add":    runPeersAdd,
+		"remove": runPeersRemove,
+	},
+	"mine": {
+		"once":  runMineOnce,
+		"start": runMineStart,
+		"stop":  runMineStop,
+	},
+}
+
+// runCommand runs the command of the command line arguments. Without a command, or with flags only,
+// it runs the node
+func runCommand(args []string) error {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return runNode(args)
+	}
+	if args[0] == "genesis" {
+		return runGenesis(args[1:])
+	}
+	group, ok := commandGroups[args[0]]
+	if !ok {
+		return fmt.Errorf("unknown command %q\n%s", args[0], usage())
+	}
+	if len(args) < 2 {
+		return fmt.Errorf("%s needs a subcommand\n%s", args[0], usage())
+	}
+	command, ok := group[args[1]]
+	if !ok {
+		return fmt.Errorf("unknown command %q\n%s", args[0]+" "+args[1], usage())
+	}
+	return command(args[2:])
+}
+
+// usage returns the list of the commands
+func usage() string {
+	groups := make([]string, 0, len(commandGroups))
+	for name := range commandGroups {
+		groups = append(groups, name)
+	}
+	sort.Strings(groups)
+	lines := []string{"Commands:", "    genesis [flags]"}
+	for _, name := range groups {
+		subs := make([]string, 0, len(commandGroups[name]))
+		for sub := range commandGroups[name] {
+			subs = append(subs, sub)
+		}
+		sort.Strings(subs)
+		lines = append(lines, fmt.Sprintf("    %s %s [flags]", name, strings.Join(subs, "|")))
+	}
+	lines = append(lines, "Run a command with -h for its flags")
+	return strings.Join(lines, "\n")
+}
+
+// apiClient talks to the local API of a running node, with the keys of its config unless flags
+// override them
+type apiClient struct {
+	url     string
+	pubKey  string
+	privKey string
+	client  *http.Client
+}
+
+// clientOptions are the flags of the commands that talk to a running node
+type clientOptions struct {
+	dataDir string
+	api     string
+}
+
+// newClientFlags returns the flags of a command that talks to a running node
+func newClientFlags(name string) (*flag.FlagSet, *clientOptions) {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	opts := &clientOptions{}
+	flags.StringVar(&opts.dataDir, "datadir", DefaultDataDir, "data directory of the node")
+	flags.StringVar(&opts.api, "api", "", "host:port of the API of the node (default: the HTTP port of the config, or the network's, on localhost)")
+	return flags, opts
+}
+
+// connect reads the config of the data directory and returns a client of the API of its node
+func (o *clientOptions) connect() (*apiClient, error) {
+	config, err := readJSON(o.dataDir)
+	if err != nil {
+		return nil, err
+	}
+	api := o.api
+	if api == "" {
+		port := config.HTTPPort
+		if port == 0 {
+			network, err := loadNetwork(config.DataDir, config.Network)
+			if err != nil {
+				return nil, err
+			}
+			port = network.httpPort
+		}
+		api = net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	}
+	return &apiClient{
+		url:     "http://" + api,
+		pubKey:  config.Node.PublicKey,
+		privKey: config.Node.PrivateKey,
+		client:  &http.Client{Timeout: time.Second * APITimeout},
+	}, nil
+}
+
+// get sends a GET request to an endpoint of the API and returns the answer
+func (c *apiClient) get(endpoint string, query url.Values) (string, error) {
+	resp, err := c.client.Get(c.url + endpoint + "?" + query.Encode())
+	if err != nil {
+		return "", fmt.Errorf("could not reach the node, is it running? %s", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	return string(body), err
+}
+
+// post sends v as JSON to an endpoint of the API and returns the answer
+func (c *apiClient) post(endpoint string, v interface{}) (string, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	resp, err := c.client.Post(c.url+endpoint, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return "", fmt.Errorf("could not reach the node, is it running? %s", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	return string(body), err
+}
+
+// postOwner sends an ownerRequest, signed by the key of the node, to an endpoint of the API and
+// returns the answer
+func (c *apiClient) postOwner(endpoint string, req *ownerRequest) (string, error) {
+	if c.privKey == "" {
+		return "", errors.New("the config has no keys, run the node once to generate them")
+	}
+	req.Timestamp = GetCurrentMillis()
+	req.Sign = ec.ECSign(ec.ECHashOwnerRequest(endpoint, req.Timestamp, req.Peer), c.privKey, c.pubKey)
+	return c.post(endpoint, req)
+}
+
+// runWalletNew generates a pair of keys, and makes them the keys of the node with -save
+func runWalletNew(args []string) error {
+	flags := flag.NewFlagSet("wallet new", flag.ContinueOnError)
+	dataDir := flags.String("datadir", DefaultDataDir, "data directory of the node")
+	save := flags.Bool("save", false, "make the keys the keys of the node in its config")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	priv, pub := ec.ECGenerateKey()
+	fmt.Printf("Generated Keys:\n    Private: %s\n    Public: %s\n", priv, pub)
+	if !*save {
+		return nil
+	}
+	config, err := readJSON(*dataDir)
+	if err != nil {
+		return err
+	}
+	config.Node.FirstInit = false
+	config.Node.PrivateKey = priv
+	config.Node.PublicKey = pub
+	if err := writeJSON(config); err != nil {
+		return err
+	}
+	fmt.Println("Saved the keys to the config, restart the node to use them")
+	return nil
+}
+
+// runWalletBalance prints the balance of a PublicKey, the node's by default
+func runWalletBalance(args []string) error {
+	flags, opts := newClientFlags("wallet balance")
+	pk := flags.String("pk", "", "PublicKey to check (default: the node's)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	c, err := opts.connect()
+	if err != nil {
+		return err
+	}
+	if *pk == "" {
+		*pk = c.pubKey
+	}
+	answer, err := c.get("/api/getBalance", url.Values{"pk": {*pk}})
+	if err != nil {
+		return err
+	}
+	fmt.Println(answer)
+	return nil
+}
+
+// runWalletSend signs a transaction with the keys of the node, or the ones of the flags, and sends
+// it to the node. It fails with the answer of the node if the node rejects the transaction
+func runWalletSend(args []string) error {
+	flags, opts := newClientFlags("wallet send")
+	to := flags.String("to", "", "PublicKey of the recipient")
+	amount := flags.Int("amount", 0, "amount to send")
+	fee := flags.Int("fee", 0, "fee for the miner")
+	priv := flags.String("priv", "", "PrivateKey to sign with (default: the node's)")
+	pub := flags.String("pub", "", "PublicKey of -priv")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *to == "" || *amount <= 0 || *fee < 0 {
+		return errors.New("a recipient, a positive amount and a fee that isn't negative are required")
+	}
+	c, err := opts.connect()
+	if err != nil {
+		return err
+	}
+	if *priv != "" || *pub != "" {
+		if *priv == "" || *pub == "" {
+			return errors.New("-priv and -pub must be used together")
+		}
+		c.privKey, c.pubKey = *priv, *pub
+	}
+	if c.privKey == "" {
+		return errors.New("the config has no keys, run the node once to generate them")
+	}
+	answer, err := c.get("/api/getNonce", url.Values{"pk": {c.pubKey}})
+	if err != nil {
+		return err
+	}
+	nonce, err := strconv.Atoi(answer)
+	if err != nil {
+		return errors.New(answer)
+	}
+	t := &Transaction{
+		senderKey:    c.pubKey,
+		recipientKey: *to,
+		amount:       *amount,
+		fee:          *fee,
+		nonce:        nonce,
+		timestamp:    GetCurrentMillis(),
+	}
+	t.hash = t.computeHash()
+	t.sign = ec.ECSign(t.hash, c.privKey, c.pubKey)
+	if answer, err = c.post("/api/sendTransaction", t); err != nil {
+		return err
+	}
+	if answer != TransactionAccepted {
+		return errors.New(answer)
+	}
+	fmt.Println(answer)
+	fmt.Printf("Transaction %s\n", t.hash)
+	return nil
+}
+
+// runChainInfo prints a summary of the blockchain of the node
+func runChainInfo(args []string) error {
+	flags, opts := newClientFlags("chain info")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	c, err := opts.connect()
+	if err != nil {
+		return err
+	}
+	answer, err := c.get("/api/getChainInfo", url.Values{})
+	if err != nil {
+		return err
+	}
+	var info ChainInfo
+	if err := json.Unmarshal([]byte(answer), &info); err != nil {
+		return errors.New(answer)
+	}
+	fmt.Printf("Network:    %s\n", info.Network)
+	fmt.Printf("Height:     %d\n", info.Height)
+	fmt.Printf("Tip:        %s\n", info.Tip)
+	fmt.Printf("Work:       %s\n", info.Work)
+	fmt.Printf("Difficulty: %d\n", info.Difficulty)
+	fmt.Printf("Supply:     %d\n", info.Supply)
+	if info.Pruned > 0 {
+		fmt.Printf("Pruned:     below index %d\n", info.Pruned)
+	}
+	fmt.Printf("Peers:      %d\n", info.Peers)
+	fmt.Printf("Mining:     %t\n", info.Mining)
+	return nil
+}
+
+// runChainVerify has the node validate every block of its blockchain and check its account state
+func runChainVerify(args []string) error {
+	flags, opts := newClientFlags("chain verify")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	return runOwnerCommand(opts, "/api/verifyChain", &ownerRequest{})
+}
+
+// runPeersList prints the peers of the node
+func runPeersList(args []string) error {
+	flags, opts := newClientFlags("peers list")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	c, err := opts.connect()
+	if err != nil {
+		return err
+	}
+	answer, err := c.get("/api/getPeers", url.Values{})
+	if err != nil {
+		return err
+	}
+	var peers []string
+	if err := json.Unmarshal([]byte(answer), &peers); err != nil {
+		return errors.New(answer)
+	}
+	for _, peer := range peers {
+		fmt.Println(peer)
+	}
+	return nil
+}
+
+// runPeersAdd adds the peer of the argument, host or host:port, to the node
+func runPeersAdd(args []string) error {
+	flags, opts := newClientFlags("peers add")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New("a single peer, as host or host:port, is required")
+	}
+	return runOwnerCommand(opts, "/api/addPeer", &ownerRequest{Peer: flags.Arg(0)})
+}
+
+// runPeersRemove removes the peer of the argument from the node and its config
+func runPeersRemove(args []string) error {
+	flags, opts := newClientFlags("peers remove")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New("a single peer, as host or host:port, is required")
+	}
+	return runOwnerCommand(opts, "/api/removePeer", &ownerRequest{Peer: flags.Arg(0)})
+}
+
+// runMineOnce has the node mine a single block
+func runMineOnce(args []string) error {
+	flags, opts := newClientFlags("mine once")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	return runOwnerCommand(opts, "/api/mineRequest", &ownerRequest{})
+}
+
+// runMineStart has the node mine blocks one after another
+func runMineStart(args []string) error {
+	flags, opts := newClientFlags("mine start")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	return runOwnerCommand(opts, "/api/startMining", &ownerRequest{})
+}
+
+// runMineStop has the node stop mining after the current block
+func runMineStop(args []string) error {
+	flags, opts := newClientFlags("mine stop")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	return runOwnerCommand(opts, "/api/stopMining", &ownerRequest{})
+}
+
+// runOwnerCommand sends an ownerRequest to an endpoint of the node and prints the answer
+func runOwnerCommand(opts *clientOptions, endpoint string, req *ownerRequest) error {
+	c, err := opts.connect()
+	if err != nil {
+		return err
+	}
+	answer, err := c.postOwner(endpoint, req)
+	if err != nil {
+		return err
+	}
+	fmt.Println(answer)
+	return nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrBelowCheckpoint is an error for a branch that would replace a checkpointed block
+	ErrBelowCheckpoint = errors.New("the branch forks below a checkpoint")
+)
+
+// Checkpoints are the hashes the blocks at certain heights must have. The blockchain never
+// reorganizes below a checkpoint it has reached
+type Checkpoints struct {
+	hashes map[int]string
+}
+
+// newCheckpoints merges the checkpoints of the network with the ones of the config. A config
+// checkpoint may not contradict the network's
+func newCheckpoints(network, config map[int]string) (*Checkpoints, error) {
+	c := &Checkpoints{hashes: make(map[int]string)}
+	for height, hash := range network {
+		c.hashes[height] = hash
+	}
+	for height, hash := range config {
+		if known, ok := c.hashes[height]; ok && known != hash {
+			return nil, fmt.Errorf("the checkpoint at height %d contradicts the network's %s", height, known)
+		}
+		c.hashes[height] = hash
+	}
+	return c, nil
+}
+
+// matches checks that a header has the hash of the checkpoint at its height, if there is one
+func (c *Checkpoints) matches(h *BlockHeader) bool {
+	hash, ok := c.hashes[h.index]
+	return !ok || hash == h.hash
+}
+
+// last returns the height of the highest checkpoint up to index, or -1 if there is none
+func (c *Checkpoints) last(index int) int {
+	last := -1
+	for height := range c.hashes {
+		if height <= index && height > last {
+			last = height
+		}
+	}
+	return last
+}
@@ -2,10 +2,13 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"fmt"
 	"net"
-	"strings"
+	"strconv"
 	"sync"
+	"time"
 )
 
 //Communicator is a struct that handles the
@@ -13,26 +16,49 @@ type Communicator struct {
 	server         *NodeServer
 	address        string
 	port           int
+	magic          uint32
 	recievedPacket chan *Packet
 	answerPacket   chan *Packet
 	mutex          *sync.Mutex
+	ctx            context.Context
+	cancel         context.CancelFunc
+	done           chan struct{}
 }
 
-//NewCommunicator creates a new Communicator and returns it
-func NewCommunicator(server *NodeServer, address string, recievedPacket, answerPacket chan *Packet, port int) *Communicator {
-	return &Communicator{server: server, address: address, recievedPacket: recievedPacket, answerPacket: answerPacket, port: port, mutex: &sync.Mutex{}}
+const (
+
+	// PeerTimeout is the time (in seconds) a peer has to answer a packet
+	PeerTimeout = 30
+)
+
+var (
+	// ErrStopped is an error for a packet sent by a Communicator that is stopping
+	ErrStopped = errors.New("the communicator is stopping")
+)
+
+//NewCommunicator creates a new Communicator that listens on port and returns it. Every packet it sends
+//carries the magic of its network and the port, and packets with another magic are refused
+func NewCommunicator(server *NodeServer, address string, recievedPacket, answerPacket chan *Packet, port int, magic uint32) *Communicator {
+	return &Communicator{server: server, address: address, recievedPacket: recievedPacket, answerPacket: answerPacket, port: port, magic: magic, mutex: &sync.Mutex{}}
 }
 
-// SR1 sends 1 Packet to address and returns the recieved packet
+// SR1 sends 1 Packet to a host:port address and returns the recieved packet
 func (c *Communicator) SR1(address string, p *Packet) (*Packet, error) {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
-	//fmt.Printf("Connecting to %s:%d...\n", address, c.port)
-	conn, err := net.Dial("tcp", fmt.Sprintf("%s:%d", address, c.port))
+	if c.ctx.Err() != nil {
+		return nil, ErrStopped
+	}
+	//fmt.Printf("Connecting to %s...\n", address)
+	dialer := &net.Dialer{Timeout: time.Second * PeerTimeout}
+	conn, err := dialer.DialContext(c.ctx, "tcp", address)
 	if err != nil {
 		return nil, err
 	}
 	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second * PeerTimeout))
+	p.magic = c.magic
+	p.port = c.port
 	bytes, err := p.MarshalJSON()
 	if err != nil {
 		return nil, err
@@ -48,26 +74,54 @@ func (c *Communicator) SR1(address string, p *Packet) (*Packet, error) {
 	}
 	msg = msg[:len(msg)-1]
 	newP := &Packet{}
-	return newP, newP.UnmarshalJSON([]byte(msg))
+	if err := newP.UnmarshalJSON([]byte(msg)); err != nil {
+		return nil, err
+	}
+	if newP.magic != c.magic {
+		return nil, ErrNetworkMagic
+	}
+	return newP, nil
 }
 
-// Listen listens for oncoming connections, recieves 1 Packet and sends one packet back
-func (c *Communicator) Listen() error {
-	fmt.Println("Listening for nodes...")
+// Start listens for oncoming connections in a goroutine until ctx is done or Stop is called
+func (c *Communicator) Start(ctx context.Context) error {
 	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", c.port))
 	if err != nil {
 		return err
 	}
+	c.ctx, c.cancel = context.WithCancel(ctx)
+	c.done = make(chan struct{})
+	go func() {
+		<-c.ctx.Done()
+		ln.Close()
+	}()
+	go func() {
+		c.listen(ln)
+		close(c.done)
+	}()
+	return nil
+}
+
+// Stop stops accepting connections and waits for the connection being handled
+func (c *Communicator) Stop() {
+	c.cancel()
+	<-c.done
+}
+
+// listen accepts oncoming connections until the listener is closed, recieves 1 Packet from each
+// and sends one packet back
+func (c *Communicator) listen(ln net.Listener) {
+	fmt.Println("Listening for nodes...")
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
+			if c.ctx.Err() != nil {
+				return
+			}
 			continue
 		}
+		conn.SetDeadline(time.Now().Add(time.Second * PeerTimeout))
 		peerAddr := conn.RemoteAddr().String()
-		peerSplat := strings.Split(peerAddr, ":")
-		if len(peerSplat) == 2 {
-			c.server.addPeer(peerSplat[0])
-		}
 		//fmt.Printf("Connected to %s\n", peerAddr)
 		msg, err := bufio.NewReader(conn).ReadString('\n')
 		if err != nil {
@@ -83,8 +137,23 @@ func (c *Communicator) Listen() error {
 			//fmt.Printf("Connection with %s closed due to error:\n	%s\n", peerAddr, err)
 			continue
 		}
+		if p.magic != c.magic {
+			conn.Close()
+			//fmt.Printf("Connection with %s closed due to error:\n	%s\n", peerAddr, ErrNetworkMagic)
+			continue
+		}
+		// the peer listens on the port its packets carry, not on the one it connected from
+		if host, _, err := net.SplitHostPort(peerAddr); err == nil {
+			if p.port > 0 {
+				c.server.addPeer(net.JoinHostPort(host, strconv.Itoa(p.port)))
+			} else {
+				c.server.addPeer(host)
+			}
+		}
 		c.recievedPacket <- p
 		p = <-c.answerPacket
+		p.magic = c.magic
+		p.port = c.port
 		bytes, err := p.MarshalJSON()
 		if err != nil {
 			conn.Close()
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+const (
+
+	// DefaultMaxBlockBytes is the maximum size (in bytes) of an encoded block
+	DefaultMaxBlockBytes = 100000
+
+	// DefaultMaxTransactions is the maximum number of transactions in a block, coinbase included
+	DefaultMaxTransactions = 1000
+
+	// DefaultMaxFutureDrift is how far (in seconds) a timestamp may be ahead of the local clock
+	// for a block, or ahead of its block for a transaction
+	DefaultMaxFutureDrift = 2 * 60 * 60
+
+	// DefaultMedianTimeWindow is the number of blocks whose median timestamp a new block must be after
+	DefaultMedianTimeWindow = 11
+)
+
+// ConsensusParams holds the limits every block of the network must respect
+type ConsensusParams struct {
+	maxBlockBytes    int
+	maxTransactions  int
+	maxFutureDrift   int64
+	medianTimeWindow int
+}
+
+// newConsensusParams creates ConsensusParams from the config, using the defaults for missing values
+func newConsensusParams(config JSONConsensus) *ConsensusParams {
+	p := &ConsensusParams{
+		maxBlockBytes:    config.MaxBlockBytes,
+		maxTransactions:  config.MaxTransactions,
+		maxFutureDrift:   config.MaxFutureDrift * 1000,
+		medianTimeWindow: config.MedianTimeWindow,
+	}
+	if p.maxBlockBytes <= 0 {
+		p.maxBlockBytes = DefaultMaxBlockBytes
+	}
+	if p.maxTransactions <= 0 {
+		p.maxTransactions = DefaultMaxTransactions
+	}
+	if p.maxFutureDrift <= 0 {
+		p.maxFutureDrift = DefaultMaxFutureDrift * 1000
+	}
+	if p.medianTimeWindow <= 0 {
+		p.medianTimeWindow = DefaultMedianTimeWindow
+	}
+	return p
+}
+
+// medianTimePast returns the median timestamp of the last blocks of chain, which a block on top
+// of it must be after
+func (p *ConsensusParams) medianTimePast(chain []*BlockHeader) int64 {
+	start := len(chain) - p.medianTimeWindow
+	if start < 0 {
+		start = 0
+	}
+	timestamps := make([]int64, 0, len(chain)-start)
+	for _, h := range chain[start:] {
+		timestamps = append(timestamps, h.timestamp)
+	}
+	if len(timestamps) == 0 {
+		return 0
+	}
+	sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+	return timestamps[len(timestamps)/2]
+}
+
+// checkBlockLimits checks that a block isn't bigger than the network allows
+func (p *ConsensusParams) checkBlockLimits(b *Block) error {
+	if len(b.transactions) > p.maxTransactions {
+		return newValidationError(b.index, b.hash, RuleTransactionCount, "%d transactions, the maximum is %d", len(b.transactions), p.maxTransactions)
+	}
+	if size := b.size(); size > p.maxBlockBytes {
+		return newValidationError(b.index, b.hash, RuleBlockSize, "%d bytes, the maximum is %d", size, p.maxBlockBytes)
+	}
+	return nil
+}
+
+// checkTransactionTime checks that a transaction has a timestamp and that it isn't too far ahead
+// of now, which is the block's timestamp or the local clock
+func (p *ConsensusParams) checkTransactionTime(t *Transaction, now int64) error {
+	if t.timestamp <= 0 {
+		return fmt.Errorf("missing timestamp")
+	}
+	if t.timestamp > now+p.maxFutureDrift {
+		return fmt.Errorf("timestamp %d is too far in the future", t.timestamp)
+	}
+	return nil
+}
+
+// ConsensusParams returns the limits the blockchain validates blocks by
+func (bc *Blockchain) ConsensusParams() *ConsensusParams {
+	return bc.consensus
+}
+
+// MedianTimePast returns the timestamp the next block must be after
+func (bc *Blockchain) MedianTimePast() int64 {
+	bc.mutex.Lock()
+	mtp := bc.consensus.medianTimePast(bc.headers)
+	bc.mutex.Unlock()
+	return mtp
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/hex"
+	"math/bits"
+)
+
+const (
+
+	// DefaultInitialDifficulty is the number of leading zero bits required from the first blocks
+	DefaultInitialDifficulty = 20
+
+	// DefaultTargetBlockTime is the time (in seconds) the network should take to mine a block
+	DefaultTargetBlockTime = 60
+
+	// DefaultRetargetWindow is the number of blocks between difficulty retargets
+	DefaultRetargetWindow = 10
+
+	// MaxRetargetStep is the maximum number of bits a retarget may change the difficulty by
+	MaxRetargetStep = 2
+)
+
+// Retarget holds the rules the difficulty of the blocks is adjusted by
+type Retarget struct {
+	initialDifficulty int
+	targetBlockTime   int64
+	window            int
+}
+
+// newRetarget creates a Retarget from the config, using the defaults for missing values
+func newRetarget(config JSONDifficulty) *Retarget {
+	r := &Retarget{
+		initialDifficulty: config.InitialDifficulty,
+		targetBlockTime:   config.TargetBlockTime * 1000,
+		window:            config.RetargetWindow,
+	}
+	if r.initialDifficulty <= 0 {
+		r.initialDifficulty = DefaultInitialDifficulty
+	}
+	if r.targetBlockTime <= 0 {
+		r.targetBlockTime = DefaultTargetBlockTime * 1000
+	}
+	if r.window <= 0 {
+		r.window = DefaultRetargetWindow
+	}
+	return r
+}
+
+// nextDifficulty returns the difficulty the block on top of chain must have. chain must start
+// at the origin block
+func (r *Retarget) nextDifficulty(chain []*BlockHeader) int {
+	height := len(chain)
+	if height <= 1 {
+		return r.initialDifficulty
+	}
+	prev := chain[height-1]
+	// the origin block has no real timestamp, so the first window is never retargeted
+	if (height-1)%r.window != 0 || height-1 <= r.window {
+		return prev.difficulty
+	}
+	span := prev.timestamp - chain[height-1-r.window].timestamp
+	if span < 1 {
+		span = 1
+	}
+	expected := int64(r.window) * r.targetBlockTime
+	delta := 0
+	for span*2 <= expected && delta < MaxRetargetStep {
+		span *= 2
+		delta++
+	}
+	for span >= expected*2 && delta > -MaxRetargetStep {
+		span /= 2
+		delta--
+	}
+	difficulty := prev.difficulty + delta
+	if difficulty < 1 {
+		difficulty = 1
+	}
+	return difficulty
+}
+
+// leadingZeroBits returns the number of leading zero bits of a hex encoded hash
+func leadingZeroBits(hash string) int {
+	data, err := hex.DecodeString(hash)
+	if err != nil {
+		return 0
+	}
+	count := 0
+	for _, v := range data {
+		count += bits.LeadingZeros8(v)
+		if v != 0 {
+			break
+		}
+	}
+	return count
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+// DirStore is a BlockStore that keeps every block in its own file, <block index>.block, in a
+// directory. A pruned block is replaced by the file of its header, <block index>.header. Only the
+// hashes of the blocks are held in memory
+type DirStore struct {
+	dir     string
+	hashes  []string
+	heights map[string]int
+	pruned  int
+}
+
+// dirBatch is a BlockBatch of a DirStore
+type dirBatch struct {
+	store *DirStore
+	ops   []batchOp
+}
+
+// openDirStore opens the DirStore in a directory, creating it if needed, and recovers it from an
+// unclean shutdown. The store ends before the first block file that is missing or corrupt. A
+// corrupt file is moved to <file>.corrupt, and the block files above the end, the header files of
+// blocks that kept their bodies and the temporary files of interrupted writes are removed. Every
+// recovery step is reported
+func openDirStore(dir string) (*DirStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	s := &DirStore{dir: dir, hashes: []string{}, heights: make(map[string]int)}
+	for {
+		height := len(s.hashes)
+		file := s.path(height)
+		var h *BlockHeader
+		b, err := s.read(height)
+		if err == nil {
+			h = b.Header()
+		} else if os.IsNotExist(err) {
+			file = s.headerPath(height)
+			h, err = s.readHeader(height)
+			if os.IsNotExist(err) {
+				break
+			}
+			if err == nil && height != s.pruned {
+				err = errors.New("the block below it kept its body")
+			}
+		}
+		if err == nil && h.index != height {
+			err = fmt.Errorf("it holds block %d", h.index)
+		}
+		if err != nil {
+			fmt.Printf("Block file %s is corrupt (%s), moved it to %s.corrupt\n", file, err, file)
+			if err := os.Rename(file, file+".corrupt"); err != nil {
+				return nil, err
+			}
+			break
+		}
+		if file == s.headerPath(height) {
+			s.pruned = height + 1
+		}
+		s.heights[h.hash] = height
+		s.hashes = append(s.hashes, h.hash)
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		name := f.Name()
+		var height int
+		if strings.Contains(name, ".block.tmp") {
+			fmt.Printf("Removed %s, left by an interrupted write\n", name)
+		} else if _, err := fmt.Sscanf(name, "%d.block", &height); err == nil && name == fmt.Sprintf("%d.block", height) && height >= len(s.hashes) {
+			fmt.Printf("Removed stale block file %s above the tip of the block store\n", name)
+		} else if _, err := fmt.Sscanf(name, "%d.header", &height); err == nil && name == fmt.Sprintf("%d.header", height) && height >= s.pruned {
+			fmt.Printf("Removed stale header file %s of a block that kept its body\n", name)
+		} else {
+			continue
+		}
+		if err := os.Remove(path.Join(dir, name)); err != nil {
+			return nil, err
+		}
+	}
+	return s, syncDir(dir)
+}
+
+// path returns the path of the file of the block at a height
+func (s *DirStore) path(height int) string {
+	return path.Join(s.dir, fmt.Sprintf("%d.block", height))
+}
+
+// headerPath returns the path of the file of the header of the pruned block at a height
+func (s *DirStore) headerPath(height int) string {
+	return path.Join(s.dir, fmt.Sprintf("%d.header", height))
+}
+
+// read reads the file of the block at a height
+func (s *DirStore) read(height int) (*Block, error) {
+	data, err := ioutil.ReadFile(s.path(height))
+	if err != nil {
+		return nil, err
+	}
+	return ToBlock(data)
+}
+
+// readHeader reads the file of the header of the pruned block at a height
+func (s *DirStore) readHeader(height int) (*BlockHeader, error) {
+	data, err := ioutil.ReadFile(s.headerPath(height))
+	if err != nil {
+		return nil, err
+	}
+	var h BlockHeader
+	if err := json.Unmarshal(data, &h); err != nil {
+		return nil, err
+	}
+	return &h, nil
+}
+
+// Get is an implementation of BlockStore
+func (s *DirStore) Get(height int) (*Block, error) {
+	if height < 0 || height >= len(s.hashes) {
+		return nil, ErrBlockNotFound
+	}
+	if height < s.pruned {
+		return nil, ErrPruned
+	}
+	return s.read(height)
+}
+
+// GetByHash is an implementation of BlockStore
+func (s *DirStore) GetByHash(hash string) (*Block, error) {
+	height, ok := s.heights[hash]
+	if !ok {
+		return nil, ErrBlockNotFound
+	}
+	return s.Get(height)
+}
+
+// GetHeader is an implementation of BlockStore
+func (s *DirStore) GetHeader(height int) (*BlockHeader, error) {
+	if height < 0 || height >= len(s.hashes) {
+		return nil, ErrBlockNotFound
+	}
+	if height < s.pruned {
+		return s.readHeader(height)
+	}
+	b, err := s.read(height)
+	if err != nil {
+		return nil, err
+	}
+	return b.Header(), nil
+}
+
+// Iterate is an implementation of BlockStore
+func (s *DirStore) Iterate(from int, fn func(*Block) error) error {
+	if from < s.pruned {
+		return ErrPruned
+	}
+	for height := from; height < len(s.hashes); height++ {
+		b, err := s.read(height)
+		if err != nil {
+			return err
+		}
+		if err := fn(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Tip is an implementation of BlockStore
+func (s *DirStore) Tip() (int, string) {
+	if len(s.hashes) == 0 {
+		return -1, ""
+	}
+	return len(s.hashes) - 1, s.hashes[len(s.hashes)-1]
+}
+
+// Pruned is an implementation of BlockStore
+func (s *DirStore) Pruned() int {
+	return s.pruned
+}
+
+// Prune is an implementation of BlockStore. The header file of a block is written before its block
+// file is removed, from the bottom up
+func (s *DirStore) Prune(height int) error {
+	for ; s.pruned < height && s.pruned < len(s.hashes); s.pruned++ {
+		b, err := s.read(s.pruned)
+		if err != nil {
+			return err
+		}
+		data, err := b.Header().MarshalJSON()
+		if err != nil {
+			return err
+		}
+		if err := writeFileAtomic(s.headerPath(s.pruned), data); err != nil {
+			return err
+		}
+		if err := os.Remove(s.path(s.pruned)); err != nil {
+			return err
+		}
+	}
+	return syncDir(s.dir)
+}
+
+// Batch is an implementation of BlockStore
+func (s *DirStore) Batch() BlockBatch {
+	return &dirBatch{store: s}
+}
+
+// Close is an implementation of BlockStore
+func (s *DirStore) Close() error {
+	return nil
+}
+
+// Put is an implementation of BlockBatch
+func (batch *dirBatch) Put(b *Block) {
+	batch.ops = append(batch.ops, batchOp{block: b, height: b.index})
+}
+
+// Truncate is an implementation of BlockBatch
+func (batch *dirBatch) Truncate(height int) {
+	batch.ops = append(batch.ops, batchOp{height: height})
+}
+
+// Commit is an implementation of BlockBatch. Every block file is written once, atomically, and
+// blocks are removed from the top down, so a crash mid-commit leaves a store that ends at some
+// block between its old and its new tip
+func (batch *dirBatch) Commit() error {
+	s := batch.store
+	for _, op := range batch.ops {
+		if op.block == nil {
+			for len(s.hashes) > op.height {
+				top := len(s.hashes) - 1
+				file := s.path(top)
+				if top < s.pruned {
+					file = s.headerPath(top)
+				}
+				if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+					return err
+				}
+				delete(s.heights, s.hashes[top])
+				s.hashes = s.hashes[:top]
+				if s.pruned > top {
+					s.pruned = top
+				}
+			}
+			continue
+		}
+		if op.height != len(s.hashes) {
+			return fmt.Errorf("cannot put block %d on top of height %d", op.height, len(s.hashes)-1)
+		}
+		data, err := op.block.ToBytes()
+		if err != nil {
+			return err
+		}
+		if err := writeFileAtomic(s.path(op.height), data); err != nil {
+			return err
+		}
+		s.heights[op.block.hash] = op.height
+		s.hashes = append(s.hashes, op.block.hash)
+	}
+	batch.ops = nil
+	return syncDir(s.dir)
+}
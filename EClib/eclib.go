@@ -6,6 +6,7 @@ import (
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
+	"encoding/binary"
 	"fmt"
 	"hash"
 	"io"
@@ -17,18 +18,37 @@ import (
 
 // EC struct is a struct full of the elliptic curve methods
 type EC struct {
-	ECGenerateKey func() (string, string)
-	ECHashString  func(string) string
-	ECSign        func(string, string, string) string
-	ECVerify      func(string, string, string) bool
+	ECGenerateKey      func() (string, string)
+	ECHashString       func(string) string
+	ECHashTransaction  func(string, string, int, int, int, int64) string
+	ECHashOwnerRequest func(string, int64, string) string
+	ECSign             func(string, string, string) string
+	ECVerify           func(string, string, string) bool
 }
 
+const (
+
+	// EncodingVersion is the version of the canonical encoding, the first byte of every encoding
+	EncodingVersion = 1
+
+	// TransactionTag is the second byte of the canonical encoding of a transaction
+	TransactionTag = 'T'
+
+	// BlockHeaderTag is the second byte of the canonical encoding of a block header
+	BlockHeaderTag = 'H'
+
+	// OwnerRequestTag is the second byte of the canonical encoding of a request of the owner of a node
+	OwnerRequestTag = 'O'
+)
+
 func main() {
 	ec := EC{
-		ECGenerateKey: ECGenerateKey,
-		ECHashString:  ECHashString,
-		ECSign:        ECSign,
-		ECVerify:      ECVerify,
+		ECGenerateKey:      ECGenerateKey,
+		ECHashString:       ECHashString,
+		ECHashTransaction:  ECHashTransaction,
+		ECHashOwnerRequest: ECHashOwnerRequest,
+		ECSign:             ECSign,
+		ECVerify:           ECVerify,
 	}
 	js.Global.Set("ec", ec)
 }
@@ -56,6 +76,86 @@ func ECHashString(toHash string) string {
 	return base64.StdEncoding.EncodeToString(h.Sum(nil))
 }
 
+// encoder builds a canonical encoding: strings and byte strings are prefixed with their length as
+// a big endian uint32, and integers are written as big endian int64
+type encoder struct {
+	data []byte
+}
+
+// newEncoder returns an encoder that starts with the version and the received tag
+func newEncoder(tag byte) *encoder {
+	return &encoder{data: []byte{EncodingVersion, tag}}
+}
+
+// writeBytes writes a length-prefixed byte string
+func (e *encoder) writeBytes(b []byte) {
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(b)))
+	e.data = append(append(e.data, length[:]...), b...)
+}
+
+// writeString writes a length-prefixed string
+func (e *encoder) writeString(s string) {
+	e.writeBytes([]byte(s))
+}
+
+// writeInt writes an integer
+func (e *encoder) writeInt(i int64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(i))
+	e.data = append(e.data, b[:]...)
+}
+
+// ECEncodeTransaction returns the canonical encoding of the signed fields of a transaction
+func ECEncodeTransaction(senderKey, recipientKey string, amount, fee, nonce int, timestamp int64) []byte {
+	e := newEncoder(TransactionTag)
+	e.writeString(senderKey)
+	e.writeString(recipientKey)
+	e.writeInt(int64(amount))
+	e.writeInt(int64(fee))
+	e.writeInt(int64(nonce))
+	e.writeInt(timestamp)
+	return e.data
+}
+
+// ECHashTransaction hashes the canonical encoding of a transaction with the sha256 algorithm.
+// The result is the hash that is signed
+func ECHashTransaction(senderKey, recipientKey string, amount, fee, nonce int, timestamp int64) string {
+	sum := sha256.Sum256(ECEncodeTransaction(senderKey, recipientKey, amount, fee, nonce, timestamp))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// ECEncodeBlockHeader returns the canonical encoding of the fields of a block header. nuance is the
+// big endian bytes of the (non negative) nuance
+func ECEncodeBlockHeader(index int, timestamp int64, miner, prevHash, merkleRoot string, difficulty int, nuance []byte) []byte {
+	e := newEncoder(BlockHeaderTag)
+	e.writeInt(int64(index))
+	e.writeInt(timestamp)
+	e.writeString(miner)
+	e.writeString(prevHash)
+	e.writeString(merkleRoot)
+	e.writeInt(int64(difficulty))
+	e.writeBytes(nuance)
+	return e.data
+}
+
+// ECEncodeOwnerRequest returns the canonical encoding of a request of the owner of a node to an
+// endpoint of its API, with the peer the request is about (if any)
+func ECEncodeOwnerRequest(endpoint string, timestamp int64, peer string) []byte {
+	e := newEncoder(OwnerRequestTag)
+	e.writeString(endpoint)
+	e.writeInt(timestamp)
+	e.writeString(peer)
+	return e.data
+}
+
+// ECHashOwnerRequest hashes the canonical encoding of a request of the owner of a node with the
+// sha256 algorithm. The result is the hash that is signed
+func ECHashOwnerRequest(endpoint string, timestamp int64, peer string) string {
+	sum := sha256.Sum256(ECEncodeOwnerRequest(endpoint, timestamp, peer))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
 // ECSign signs a string with a private and public key and returns the sign string
 func ECSign(toSign string, D string, publicKey string) string {
 	var d big.Int
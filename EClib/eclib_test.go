@@ -0,0 +1,120 @@
+package eclib
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"testing"
+)
+
+// vectors is the content of vectors.json
+type vectors struct {
+	Version      int `json:"version"`
+	Transactions []struct {
+		SenderKey    string `json:"senderKey"`
+		RecipientKey string `json:"recipientKey"`
+		Amount       int    `json:"amount"`
+		Fee          int    `json:"fee"`
+		Nonce        int    `json:"nonce"`
+		Timestamp    int64  `json:"timestamp"`
+		Encoding     string `json:"encoding"`
+		Hash         string `json:"hash"`
+	} `json:"transactions"`
+	BlockHeaders []struct {
+		Index      int    `json:"index"`
+		Timestamp  int64  `json:"timestamp"`
+		Miner      string `json:"miner"`
+		PrevHash   string `json:"prevHash"`
+		MerkleRoot string `json:"merkleRoot"`
+		Difficulty int    `json:"difficulty"`
+		Nuance     string `json:"nuance"`
+		Encoding   string `json:"encoding"`
+		Hash       string `json:"hash"`
+	} `json:"blockHeaders"`
+	OwnerRequests []struct {
+		Endpoint  string `json:"endpoint"`
+		Timestamp int64  `json:"timestamp"`
+		Peer      string `json:"peer"`
+		Encoding  string `json:"encoding"`
+		Hash      string `json:"hash"`
+	} `json:"ownerRequests"`
+}
+
+// readVectors reads the test vectors that the Go node and eclib.js must both reproduce
+func readVectors(t *testing.T) *vectors {
+	data, err := ioutil.ReadFile("vectors.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := &vectors{}
+	if err := json.Unmarshal(data, v); err != nil {
+		t.Fatal(err)
+	}
+	if v.Version != EncodingVersion {
+		t.Fatalf("the vectors are of encoding version %d, not %d", v.Version, EncodingVersion)
+	}
+	return v
+}
+
+func TestEncodeTransactionVectors(t *testing.T) {
+	v := readVectors(t)
+	if len(v.Transactions) == 0 {
+		t.Fatal("no transaction vectors")
+	}
+	for i, tv := range v.Transactions {
+		encoding := ECEncodeTransaction(tv.SenderKey, tv.RecipientKey, tv.Amount, tv.Fee, tv.Nonce, tv.Timestamp)
+		if got := hex.EncodeToString(encoding); got != tv.Encoding {
+			t.Errorf("transaction %d: encoding is %s, expected %s", i, got, tv.Encoding)
+		}
+		if got := ECHashTransaction(tv.SenderKey, tv.RecipientKey, tv.Amount, tv.Fee, tv.Nonce, tv.Timestamp); got != tv.Hash {
+			t.Errorf("transaction %d: hash is %s, expected %s", i, got, tv.Hash)
+		}
+	}
+}
+
+func TestEncodeBlockHeaderVectors(t *testing.T) {
+	v := readVectors(t)
+	if len(v.BlockHeaders) == 0 {
+		t.Fatal("no block header vectors")
+	}
+	for i, hv := range v.BlockHeaders {
+		nuance, ok := new(big.Int).SetString(hv.Nuance, 10)
+		if !ok || nuance.Sign() < 0 {
+			t.Fatalf("block header %d: invalid nuance %q", i, hv.Nuance)
+		}
+		encoding := ECEncodeBlockHeader(hv.Index, hv.Timestamp, hv.Miner, hv.PrevHash, hv.MerkleRoot, hv.Difficulty, nuance.Bytes())
+		if got := hex.EncodeToString(encoding); got != hv.Encoding {
+			t.Errorf("block header %d: encoding is %s, expected %s", i, got, hv.Encoding)
+		}
+		sum := sha256.Sum256(encoding)
+		if got := hex.EncodeToString(sum[:]); got != hv.Hash {
+			t.Errorf("block header %d: hash is %s, expected %s", i, got, hv.Hash)
+		}
+	}
+}
+
+func TestEncodeOwnerRequestVectors(t *testing.T) {
+	v := readVectors(t)
+	if len(v.OwnerRequests) == 0 {
+		t.Fatal("no owner request vectors")
+	}
+	for i, ov := range v.OwnerRequests {
+		if got := hex.EncodeToString(ECEncodeOwnerRequest(ov.Endpoint, ov.Timestamp, ov.Peer)); got != ov.Encoding {
+			t.Errorf("owner request %d: encoding is %s, expected %s", i, got, ov.Encoding)
+		}
+		if got := ECHashOwnerRequest(ov.Endpoint, ov.Timestamp, ov.Peer); got != ov.Hash {
+			t.Errorf("owner request %d: hash is %s, expected %s", i, got, ov.Hash)
+		}
+	}
+}
+
+func TestEncodingsAreUnambiguous(t *testing.T) {
+	// the same characters split differently between the keys must not encode the same
+	a := ECEncodeTransaction("ab", "c", 1, 0, 0, 0)
+	b := ECEncodeTransaction("a", "bc", 1, 0, 0, 0)
+	if hex.EncodeToString(a) == hex.EncodeToString(b) {
+		t.Fatal("different keys have the same encoding")
+	}
+}
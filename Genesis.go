@@ -0,0 +1,175 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Allocation is an amount of coins the origin block credits to a PublicKey
+type Allocation struct {
+	Key    string
+	Amount int
+}
+
+// newGenesisBlock creates an origin block that credits every allocation through a coinbase and
+// mines it at the received difficulty. The origin block has no parent and no miner, so its miner
+// field carries the message
+func newGenesisBlock(timestamp int64, message string, difficulty int, allocations []Allocation) *Block {
+	b := &Block{
+		index:        0,
+		timestamp:    timestamp,
+		miner:        message,
+		transactions: []*Transaction{},
+		difficulty:   difficulty,
+	}
+	for _, a := range allocations {
+		b.transactions = append(b.transactions, newCoinbase(a.Key, a.Amount, 0, timestamp))
+	}
+	b.merkleRoot = computeMerkleRoot(b.transactions)
+	for counter := int64(0); ; counter++ {
+		b.nuance = big.NewInt(counter)
+		b.updateHash()
+		if b.verifyPOW() {
+			return b
+		}
+	}
+}
+
+// premine returns the number of coins the origin block of the network created
+func (n *Network) premine() int {
+	sum := 0
+	for _, t := range n.genesis.transactions {
+		sum += t.amount
+	}
+	return sum
+}
+
+// parseAllocations parses allocations in the format of <key>:<amount>,<key>:<amount>. Allocations to
+// the same PublicKey are merged
+func parseAllocations(s string) ([]Allocation, error) {
+	allocations := make([]Allocation, 0)
+	positions := make(map[string]int)
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		sep := strings.LastIndex(item, ":")
+		if sep <= 0 {
+			return nil, fmt.Errorf("invalid allocation %q", item)
+		}
+		key := item[:sep]
+		amount, err := strconv.Atoi(item[sep+1:])
+		if err != nil || amount <= 0 {
+			return nil, fmt.Errorf("invalid amount in allocation %q", item)
+		}
+		if i, ok := positions[key]; ok {
+			allocations[i].Amount += amount
+			continue
+		}
+		positions[key] = len(allocations)
+		allocations = append(allocations, Allocation{Key: key, Amount: amount})
+	}
+	return allocations, nil
+}
+
+// runGenesis builds the origin block of a new network from the command line arguments, and writes
+// its profile to Networks/<name>.json in the data directory and the block to its Blockchain directory.
+// It also selects the new network in config.json, creating it if needed, unless -keep-config is set
+func runGenesis(args []string) error {
+	flags := flag.NewFlagSet("genesis", flag.ContinueOnError)
+	dataDir := flags.String("datadir", DefaultDataDir, "data directory to write the network to")
+	name := flags.String("network", "", "name of the new network")
+	base := flags.String("base", Regtest, "network whose rules and ports the new network starts from")
+	timestamp := flags.Int64("timestamp", GetCurrentMillis(), "timestamp of the origin block in millisecs")
+	difficulty := flags.Int("difficulty", 0, "leading zero bits of the origin block and the first blocks, at least 1 (default: the base network's)")
+	message := flags.String("message", "", "message to put in the origin block")
+	premine := flags.String("premine", "", "allocations of the origin block, as <key>:<amount>,<key>:<amount>")
+	magic := flags.Uint("magic", 0, "network magic (default: derived from the origin block)")
+	p2pPort := flags.Int("p2p-port", 0, "P2P port (default: the base network's)")
+	httpPort := flags.Int("http-port", 0, "HTTP port (default: the base network's)")
+	keepConfig := flags.Bool("keep-config", false, "don't select the new network in config.json")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	difficultySet := false
+	flags.Visit(func(f *flag.Flag) {
+		difficultySet = difficultySet || f.Name == "difficulty"
+	})
+	if difficultySet && *difficulty < 1 {
+		return errors.New("the difficulty must be at least 1")
+	}
+	if *name == "" || strings.ContainsAny(*name, "/\\. ") {
+		return errors.New("a network name without spaces, dots or slashes is required")
+	}
+	if _, err := builtinNetwork(*name); err == nil {
+		return fmt.Errorf("%s is a built-in network", *name)
+	}
+	network, err := loadNetwork(*dataDir, *base)
+	if err != nil {
+		return err
+	}
+	allocations, err := parseAllocations(*premine)
+	if err != nil {
+		return err
+	}
+	network.name = *name
+	if difficultySet {
+		network.difficulty.InitialDifficulty = *difficulty
+	}
+	if *p2pPort > 0 {
+		network.p2pPort = *p2pPort
+	}
+	if *httpPort > 0 {
+		network.httpPort = *httpPort
+	}
+	fmt.Printf("Mining the origin block of %s at difficulty %d...\n", *name, network.difficulty.InitialDifficulty)
+	network.genesis = newGenesisBlock(*timestamp, *message, network.difficulty.InitialDifficulty, allocations)
+	network.magic = uint32(*magic)
+	if network.magic == 0 {
+		magic, err := strconv.ParseUint(network.genesis.hash[:8], 16, 32)
+		if err != nil {
+			return err
+		}
+		network.magic = uint32(magic)
+	}
+	if err := network.save(*dataDir); err != nil {
+		return err
+	}
+	chainDir := network.dataDir(*dataDir)
+	if err := os.MkdirAll(path.Join(chainDir, "Blockchain"), 0755); err != nil {
+		return err
+	}
+	data, err := network.genesis.MarshalJSON()
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path.Join(chainDir, "Blockchain", "0.block"), data, 0644); err != nil {
+		return err
+	}
+	fmt.Printf("Created network %s with origin block %s and a premine of %d\n", *name, network.genesis.hash, network.premine())
+	if *keepConfig {
+		fmt.Printf("Set \"Network\" to \"%s\" in %s to join it\n", *name, path.Join(*dataDir, "config.json"))
+		return nil
+	}
+	config, err := readJSON(*dataDir)
+	if os.IsNotExist(err) {
+		config, err = newConfig(*dataDir), nil
+	}
+	if err != nil {
+		return err
+	}
+	config.Network = *name
+	if err := writeJSON(config); err != nil {
+		return err
+	}
+	fmt.Printf("Selected network %s in %s\n", *name, path.Join(*dataDir, "config.json"))
+	return nil
+}
@@ -4,12 +4,13 @@ import (
 	"encoding/json"
 	"io/ioutil"
 	"math/big"
-	"os"
 	"path"
 )
 
 // JSONPacket is a struct intended for Json encoding and decoding
 type JSONPacket struct {
+	Magic       uint32 `json:"magic"`
+	Port        int    `json:"port,omitempty"`
 	RequestType string `json:"requestType"`
 	Data        []byte `json:"data"`
 }
@@ -17,6 +18,8 @@ type JSONPacket struct {
 // MarshalJSON is an Implementation of Marshaler
 func (p *Packet) MarshalJSON() ([]byte, error) {
 	jp := JSONPacket{
+		Magic:       p.magic,
+		Port:        p.port,
 		RequestType: p.requestType,
 		Data:        p.data,
 	}
@@ -30,6 +33,8 @@ func (p *Packet) UnmarshalJSON(data []byte) error {
 		return err
 	}
 	*p = Packet{
+		magic:       jp.Magic,
+		port:        jp.Port,
 		requestType: jp.RequestType,
 		data:        jp.Data,
 	}
@@ -43,6 +48,8 @@ type JSONTransaction struct {
 	SenderKey    string `json:"senderKey"`
 	RecipientKey string `json:"recipientKey"`
 	Amount       int    `json:"amount"`
+	Fee          int    `json:"fee"`
+	Nonce        int    `json:"nonce"`
 	Timestamp    int64  `json:"timestamp"`
 	Hash         string `json:"hash"`
 	Sign         string `json:"sign"`
@@ -54,6 +61,8 @@ func (t *Transaction) MarshalJSON() ([]byte, error) {
 		SenderKey:    t.senderKey,
 		RecipientKey: t.recipientKey,
 		Amount:       t.amount,
+		Fee:          t.fee,
+		Nonce:        t.nonce,
 		Timestamp:    t.timestamp,
 		Hash:         t.hash,
 		Sign:         t.sign,
@@ -71,6 +80,8 @@ func (t *Transaction) UnmarshalJSON(data []byte) error {
 		senderKey:    jt.SenderKey,
 		recipientKey: jt.RecipientKey,
 		amount:       jt.Amount,
+		fee:          jt.Fee,
+		nonce:        jt.Nonce,
 		timestamp:    jt.Timestamp,
 		hash:         jt.Hash,
 		sign:         jt.Sign,
@@ -88,6 +99,8 @@ type JSONBlock struct {
 	Miner        string         `json:"miner"`
 	Hash         string         `json:"hash"`
 	PrevHash     string         `json:"prevHash"`
+	MerkleRoot   string         `json:"merkleRoot"`
+	Difficulty   int            `json:"difficulty"`
 	Nuance       *big.Int       `json:"nuance"`
 }
 
@@ -100,6 +113,8 @@ func (b *Block) MarshalJSON() ([]byte, error) {
 		Miner:        b.miner,
 		Hash:         b.hash,
 		PrevHash:     b.prevHash,
+		MerkleRoot:   b.merkleRoot,
+		Difficulty:   b.difficulty,
 		Nuance:       b.nuance,
 	}
 	return json.Marshal(jb)
@@ -118,6 +133,8 @@ func (b *Block) UnmarshalJSON(data []byte) error {
 		miner:        jb.Miner,
 		hash:         jb.Hash,
 		prevHash:     jb.PrevHash,
+		merkleRoot:   jb.MerkleRoot,
+		difficulty:   jb.Difficulty,
 		nuance:       jb.Nuance,
 	}
 	return nil
@@ -125,6 +142,104 @@ func (b *Block) UnmarshalJSON(data []byte) error {
 
 //------------------------------------------------------------------------------------------------------------------------------
 
+// JSONAccountState is a struct intended for Json encoding and decoding
+type JSONAccountState struct {
+	Balances map[string]int `json:"balances"`
+	Nonces   map[string]int `json:"nonces"`
+}
+
+// MarshalJSON is an Implementation of Marshaler
+func (s *AccountState) MarshalJSON() ([]byte, error) {
+	js := JSONAccountState{
+		Balances: s.balances,
+		Nonces:   s.nonces,
+	}
+	return json.Marshal(js)
+}
+
+// UnmarshalJSON is an Implementation of Unmarshaler
+func (s *AccountState) UnmarshalJSON(data []byte) error {
+	var js JSONAccountState
+	if err := json.Unmarshal(data, &js); err != nil {
+		return err
+	}
+	*s = *newAccountState()
+	for key, balance := range js.Balances {
+		s.balances[key] = balance
+	}
+	for key, nonce := range js.Nonces {
+		s.nonces[key] = nonce
+	}
+	return nil
+}
+
+// JSONSavedState is the account state saved in a data directory, with the index and the hash of
+// the block it is the state at
+type JSONSavedState struct {
+	Height int           `json:"height"`
+	Tip    string        `json:"tip"`
+	State  *AccountState `json:"state"`
+}
+
+// JSONSnapshotMeta describes the blockchain in a snapshot
+type JSONSnapshotMeta struct {
+	Network string `json:"network"`
+	Genesis string `json:"genesis"`
+	Height  int    `json:"height"`
+	Tip     string `json:"tip"`
+	Created int64  `json:"created"`
+}
+
+//------------------------------------------------------------------------------------------------------------------------------
+
+// JSONBlockHeader is a struct intended for Json encoding and decoding
+type JSONBlockHeader struct {
+	Index      int      `json:"index"`
+	Timestamp  int64    `json:"timestamp"`
+	Miner      string   `json:"miner"`
+	Hash       string   `json:"hash"`
+	PrevHash   string   `json:"prevHash"`
+	MerkleRoot string   `json:"merkleRoot"`
+	Difficulty int      `json:"difficulty"`
+	Nuance     *big.Int `json:"nuance"`
+}
+
+// MarshalJSON is an Implementation of Marshaler
+func (h *BlockHeader) MarshalJSON() ([]byte, error) {
+	jh := JSONBlockHeader{
+		Index:      h.index,
+		Timestamp:  h.timestamp,
+		Miner:      h.miner,
+		Hash:       h.hash,
+		PrevHash:   h.prevHash,
+		MerkleRoot: h.merkleRoot,
+		Difficulty: h.difficulty,
+		Nuance:     h.nuance,
+	}
+	return json.Marshal(jh)
+}
+
+// UnmarshalJSON is an Implementation of Unmarshaler
+func (h *BlockHeader) UnmarshalJSON(data []byte) error {
+	var jh JSONBlockHeader
+	if err := json.Unmarshal(data, &jh); err != nil {
+		return err
+	}
+	*h = BlockHeader{
+		index:      jh.Index,
+		timestamp:  jh.Timestamp,
+		miner:      jh.Miner,
+		hash:       jh.Hash,
+		prevHash:   jh.PrevHash,
+		merkleRoot: jh.MerkleRoot,
+		difficulty: jh.Difficulty,
+		nuance:     jh.Nuance,
+	}
+	return nil
+}
+
+//------------------------------------------------------------------------------------------------------------------------------
+
 // JSONNode is a data type for the json settings file
 type JSONNode struct {
 	FirstInit  bool   `json:"FirstInit"`
@@ -139,21 +254,101 @@ func checkError(err error) {
 	}
 }
 
+// JSONDifficulty is a data type for the difficulty retargeting settings
+type JSONDifficulty struct {
+	InitialDifficulty int   `json:"InitialDifficulty"`
+	TargetBlockTime   int64 `json:"TargetBlockTime"`
+	RetargetWindow    int   `json:"RetargetWindow"`
+}
+
+// JSONMonetaryPolicy is a data type for the block reward settings
+type JSONMonetaryPolicy struct {
+	InitialSubsidy  int `json:"InitialSubsidy"`
+	HalvingInterval int `json:"HalvingInterval"`
+	MaxSupply       int `json:"MaxSupply"`
+}
+
+// JSONConsensus is a data type for the block size and timestamp limits
+type JSONConsensus struct {
+	MaxBlockBytes    int   `json:"MaxBlockBytes"`
+	MaxTransactions  int   `json:"MaxTransactions"`
+	MaxFutureDrift   int64 `json:"MaxFutureDrift"`
+	MedianTimeWindow int   `json:"MedianTimeWindow"`
+}
+
+// JSONNetwork is a struct intended for Json encoding and decoding
+type JSONNetwork struct {
+	Name           string             `json:"Name"`
+	Magic          uint32             `json:"Magic"`
+	P2PPort        int                `json:"P2PPort"`
+	HTTPPort       int                `json:"HTTPPort"`
+	Genesis        *Block             `json:"Genesis"`
+	Difficulty     JSONDifficulty     `json:"Difficulty"`
+	MonetaryPolicy JSONMonetaryPolicy `json:"MonetaryPolicy"`
+	Consensus      JSONConsensus      `json:"Consensus"`
+	Checkpoints    map[int]string     `json:"Checkpoints,omitempty"`
+}
+
+// MarshalJSON is an Implementation of Marshaler
+func (n *Network) MarshalJSON() ([]byte, error) {
+	jn := JSONNetwork{
+		Name:           n.name,
+		Magic:          n.magic,
+		P2PPort:        n.p2pPort,
+		HTTPPort:       n.httpPort,
+		Genesis:        n.genesis,
+		Difficulty:     n.difficulty,
+		MonetaryPolicy: n.policy,
+		Consensus:      n.consensus,
+		Checkpoints:    n.checkpoints,
+	}
+	return json.Marshal(jn)
+}
+
+// UnmarshalJSON is an Implementation of Unmarshaler
+func (n *Network) UnmarshalJSON(data []byte) error {
+	var jn JSONNetwork
+	if err := json.Unmarshal(data, &jn); err != nil {
+		return err
+	}
+	*n = Network{
+		name:        jn.Name,
+		magic:       jn.Magic,
+		p2pPort:     jn.P2PPort,
+		httpPort:    jn.HTTPPort,
+		genesis:     jn.Genesis,
+		difficulty:  jn.Difficulty,
+		policy:      jn.MonetaryPolicy,
+		consensus:   jn.Consensus,
+		checkpoints: jn.Checkpoints,
+	}
+	return nil
+}
+
 //--------------------------------------------------------------------------------------------------------------
 
 //JSONConfig is
 type JSONConfig struct {
-	Addr  string
-	Node  JSONNode
-	Peers string
+	Addr        string
+	Node        JSONNode
+	Peers       string
+	Network     string
+	Store       string
+	Checkpoints map[int]string `json:",omitempty"`
+	AssumeValid string         `json:",omitempty"`
+	Prune       int            `json:",omitempty"`
+	P2PPort     int            `json:",omitempty"`
+	HTTPPort    int            `json:",omitempty"`
+	DataDir     string         `json:"-"`
 }
 
-// readJSON read the config.json file from /Config/ and returns it as a JSONConfig
-func readJSON() (*JSONConfig, error) {
-	dir, err := os.Getwd()
-	checkError(err)
-	dir = path.Join(dir, "Config/config.json")
-	data, err := ioutil.ReadFile(dir)
+// readJSON read the config.json file from a data directory, /Config/ if it's empty, and returns it
+// as a JSONConfig
+func readJSON(dataDir string) (*JSONConfig, error) {
+	if dataDir == "" {
+		dataDir = DefaultDataDir
+	}
+	data, err := ioutil.ReadFile(path.Join(dataDir, "config.json"))
 	if err != nil {
 		return nil, err
 	}
@@ -162,18 +357,21 @@ func readJSON() (*JSONConfig, error) {
 	if err != nil {
 		return nil, err
 	}
+	config.DataDir = dataDir
 	return &config, err
 }
 
-// writeJSON writes a JSONConfig into the config.json file in /Config/
+// newConfig returns the config of a new node in a data directory, which generates its keys on its
+// first run and joins the main network
+func newConfig(dataDir string) *JSONConfig {
+	return &JSONConfig{Node: JSONNode{FirstInit: true}, Network: Mainnet, Store: StoreDir, DataDir: dataDir}
+}
+
+// writeJSON writes a JSONConfig into the config.json file in the data directory it was read from
 func writeJSON(config *JSONConfig) error {
 	data, err := json.Marshal(config)
 	if err != nil {
 		return err
 	}
-	dir, err := os.Getwd()
-	checkError(err)
-	dir = path.Join(dir, "Config/config.json")
-	err = ioutil.WriteFile(dir, data, 0644)
-	return err
+	return writeFileAtomic(path.Join(config.DataDir, "config.json"), data)
 }
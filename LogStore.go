@@ -0,0 +1,456 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+)
+
+const (
+	// logPut is the record of a block put on top of a LogStore
+	logPut = 'P'
+	// logTruncate is the record of a truncation of a LogStore
+	logTruncate = 'T'
+	// logCommit is the record that ends a committed batch
+	logCommit = 'C'
+	// logHeader is the record of the header of a pruned block, written when the log is compacted
+	logHeader = 'H'
+	// maxLogRecord is the largest payload of a record. A longer length can only be corrupt
+	maxLogRecord = 256 << 20
+)
+
+var (
+	// errLogRecord is returned for a log record that is cut or doesn't match its checksum
+	errLogRecord = errors.New("invalid log record")
+)
+
+// LogStore is a BlockStore that keeps the blocks in a single append-only log file. Every record is
+// its payload length and CRC-32 followed by the payload, and a batch only counts once its commit
+// record is written, so a crash mid-batch loses the batch but never corrupts the store. Only the
+// locations and the hashes of the blocks are held in memory. Pruning rewrites the log with header
+// records in place of the put records of the pruned blocks
+type LogStore struct {
+	file    *os.File
+	size    int64
+	entries []logEntry
+	heights map[string]int
+	pruned  int
+}
+
+// logEntry is the location of the put or header record of a block in the log
+type logEntry struct {
+	hash   string
+	offset int64
+	length int
+	header bool
+}
+
+// logOp is a change to the index of a LogStore. A negative truncate puts entry on top
+type logOp struct {
+	truncate int
+	entry    logEntry
+}
+
+// logBatch is a BlockBatch of a LogStore
+type logBatch struct {
+	store *LogStore
+	ops   []batchOp
+}
+
+// openLogStore opens the LogStore in a file, creating it if needed. Records after the last commit
+// record are cut off
+func openLogStore(file string) (*LogStore, error) {
+	f, err := os.OpenFile(file, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	s := &LogStore{file: f, entries: []logEntry{}, heights: make(map[string]int)}
+	if err := s.replay(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// replay rebuilds the index of the store from its log, and cuts off and reports the records after
+// the last commit record
+func (s *LogStore) replay() error {
+	r := bufio.NewReader(s.file)
+	var offset int64
+	var stop error
+	pending := make([]logOp, 0)
+	for {
+		payload, err := readLogRecord(r)
+		if err != nil {
+			stop = err
+			break
+		}
+		start := offset + 8
+		offset = start + int64(len(payload))
+		switch payload[0] {
+		case logPut, logHeader:
+			hash, _, err := decodeLogEntry(payload)
+			if err != nil {
+				return err
+			}
+			entry := logEntry{hash: hash, offset: start, length: len(payload), header: payload[0] == logHeader}
+			pending = append(pending, logOp{truncate: -1, entry: entry})
+		case logTruncate:
+			if len(payload) != 9 {
+				return errLogRecord
+			}
+			pending = append(pending, logOp{truncate: int(binary.BigEndian.Uint64(payload[1:]))})
+		case logCommit:
+			s.apply(pending)
+			pending = pending[:0]
+			s.size = offset
+		}
+	}
+	end, err := s.file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if end > s.size {
+		reason := "an unfinished batch"
+		if stop == io.ErrUnexpectedEOF {
+			reason = "a cut record"
+		} else if stop == errLogRecord {
+			reason = "a corrupt record"
+		}
+		fmt.Printf("Cut off %d bytes of %s after the last commit of %s\n", end-s.size, reason, s.file.Name())
+		if err := s.file.Truncate(s.size); err != nil {
+			return err
+		}
+	}
+	_, err = s.file.Seek(s.size, io.SeekStart)
+	return err
+}
+
+// apply applies committed changes to the index
+func (s *LogStore) apply(ops []logOp) {
+	for _, op := range ops {
+		if op.truncate < 0 {
+			if op.entry.header {
+				s.pruned = len(s.entries) + 1
+			}
+			s.heights[op.entry.hash] = len(s.entries)
+			s.entries = append(s.entries, op.entry)
+			continue
+		}
+		for len(s.entries) > op.truncate {
+			top := len(s.entries) - 1
+			delete(s.heights, s.entries[top].hash)
+			s.entries = s.entries[:top]
+		}
+		if s.pruned > len(s.entries) {
+			s.pruned = len(s.entries)
+		}
+	}
+}
+
+// readLogRecord reads a single record and returns its payload. The payload is read as it arrives
+// instead of being allocated from its length up front, so a corrupt length can't allocate more
+// than the reader holds
+func readLogRecord(r io.Reader) ([]byte, error) {
+	var head [8]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return nil, err
+	}
+	length := int64(binary.BigEndian.Uint32(head[:4]))
+	if length > maxLogRecord {
+		return nil, errLogRecord
+	}
+	payload, err := ioutil.ReadAll(io.LimitReader(r, length))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(payload)) < length {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if len(payload) == 0 || crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(head[4:]) {
+		return nil, errLogRecord
+	}
+	return payload, nil
+}
+
+// encodeLogRecord returns a record of a payload
+func encodeLogRecord(payload []byte) []byte {
+	record := make([]byte, 8, 8+len(payload))
+	binary.BigEndian.PutUint32(record[:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:], crc32.ChecksumIEEE(payload))
+	return append(record, payload...)
+}
+
+// encodeLogPut returns the payload of a put record: the hash of the block, length-prefixed, and the
+// encoded block
+func encodeLogPut(b *Block) ([]byte, error) {
+	data, err := b.ToBytes()
+	if err != nil {
+		return nil, err
+	}
+	return encodeLogEntry(logPut, b.hash, data), nil
+}
+
+// encodeLogHeader returns the payload of a header record: the hash of the block, length-prefixed,
+// and the encoded header
+func encodeLogHeader(h *BlockHeader) ([]byte, error) {
+	data, err := h.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+	return encodeLogEntry(logHeader, h.hash, data), nil
+}
+
+// encodeLogEntry returns the payload of a record of the received kind with a hash and data
+func encodeLogEntry(kind byte, hash string, data []byte) []byte {
+	payload := make([]byte, 5, 5+len(hash)+len(data))
+	payload[0] = kind
+	binary.BigEndian.PutUint32(payload[1:], uint32(len(hash)))
+	payload = append(payload, hash...)
+	return append(payload, data...)
+}
+
+// decodeLogEntry returns the hash and the encoded block or header of a put or header record
+func decodeLogEntry(payload []byte) (string, []byte, error) {
+	if len(payload) < 5 {
+		return "", nil, errLogRecord
+	}
+	n := int(binary.BigEndian.Uint32(payload[1:5]))
+	if len(payload) < 5+n {
+		return "", nil, errLogRecord
+	}
+	return string(payload[5 : 5+n]), payload[5+n:], nil
+}
+
+// read reads the payload of the record of the block at a height
+func (s *LogStore) read(height int) ([]byte, error) {
+	e := s.entries[height]
+	payload := make([]byte, e.length)
+	if _, err := s.file.ReadAt(payload, e.offset); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+// Get is an implementation of BlockStore
+func (s *LogStore) Get(height int) (*Block, error) {
+	if height < 0 || height >= len(s.entries) {
+		return nil, ErrBlockNotFound
+	}
+	if s.entries[height].header {
+		return nil, ErrPruned
+	}
+	payload, err := s.read(height)
+	if err != nil {
+		return nil, err
+	}
+	_, data, err := decodeLogEntry(payload)
+	if err != nil {
+		return nil, err
+	}
+	return ToBlock(data)
+}
+
+// GetHeader is an implementation of BlockStore
+func (s *LogStore) GetHeader(height int) (*BlockHeader, error) {
+	if height < 0 || height >= len(s.entries) {
+		return nil, ErrBlockNotFound
+	}
+	payload, err := s.read(height)
+	if err != nil {
+		return nil, err
+	}
+	_, data, err := decodeLogEntry(payload)
+	if err != nil {
+		return nil, err
+	}
+	if s.entries[height].header {
+		var h BlockHeader
+		if err := json.Unmarshal(data, &h); err != nil {
+			return nil, err
+		}
+		return &h, nil
+	}
+	b, err := ToBlock(data)
+	if err != nil {
+		return nil, err
+	}
+	return b.Header(), nil
+}
+
+// GetByHash is an implementation of BlockStore
+func (s *LogStore) GetByHash(hash string) (*Block, error) {
+	height, ok := s.heights[hash]
+	if !ok {
+		return nil, ErrBlockNotFound
+	}
+	return s.Get(height)
+}
+
+// Iterate is an implementation of BlockStore
+func (s *LogStore) Iterate(from int, fn func(*Block) error) error {
+	if from < s.pruned {
+		return ErrPruned
+	}
+	for height := from; height < len(s.entries); height++ {
+		b, err := s.Get(height)
+		if err != nil {
+			return err
+		}
+		if err := fn(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Tip is an implementation of BlockStore
+func (s *LogStore) Tip() (int, string) {
+	if len(s.entries) == 0 {
+		return -1, ""
+	}
+	return len(s.entries) - 1, s.entries[len(s.entries)-1].hash
+}
+
+// Pruned is an implementation of BlockStore
+func (s *LogStore) Pruned() int {
+	return s.pruned
+}
+
+// Prune is an implementation of BlockStore. The log is compacted into a new file that holds a single
+// committed batch, with header records for the pruned blocks, which atomically replaces it
+func (s *LogStore) Prune(height int) error {
+	if height > len(s.entries) {
+		height = len(s.entries)
+	}
+	if height <= s.pruned {
+		return nil
+	}
+	name := s.file.Name()
+	f, err := ioutil.TempFile(path.Dir(name), path.Base(name)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	entries := make([]logEntry, len(s.entries))
+	var offset int64
+	for i, e := range s.entries {
+		payload, err := s.read(i)
+		if err != nil {
+			return err
+		}
+		if i < height && !e.header {
+			h, err := s.GetHeader(i)
+			if err != nil {
+				return err
+			}
+			if payload, err = encodeLogHeader(h); err != nil {
+				return err
+			}
+		}
+		if _, err := w.Write(encodeLogRecord(payload)); err != nil {
+			return err
+		}
+		entries[i] = logEntry{hash: e.hash, offset: offset + 8, length: len(payload), header: i < height}
+		offset += 8 + int64(len(payload))
+	}
+	commit := encodeLogRecord([]byte{logCommit})
+	if _, err := w.Write(commit); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), name); err != nil {
+		return err
+	}
+	if err := syncDir(path.Dir(name)); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(name, os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	s.file.Close()
+	s.file = file
+	s.size = offset + int64(len(commit))
+	s.entries = entries
+	s.pruned = height
+	return nil
+}
+
+// Batch is an implementation of BlockStore
+func (s *LogStore) Batch() BlockBatch {
+	return &logBatch{store: s}
+}
+
+// Close is an implementation of BlockStore
+func (s *LogStore) Close() error {
+	return s.file.Close()
+}
+
+// Put is an implementation of BlockBatch
+func (batch *logBatch) Put(b *Block) {
+	batch.ops = append(batch.ops, batchOp{block: b, height: b.index})
+}
+
+// Truncate is an implementation of BlockBatch
+func (batch *logBatch) Truncate(height int) {
+	batch.ops = append(batch.ops, batchOp{height: height})
+}
+
+// Commit is an implementation of BlockBatch. The records of the batch and its commit record are
+// appended and synced before the index changes
+func (batch *logBatch) Commit() error {
+	s := batch.store
+	data := make([]byte, 0)
+	ops := make([]logOp, 0, len(batch.ops))
+	height := len(s.entries)
+	for _, op := range batch.ops {
+		if op.block == nil {
+			payload := make([]byte, 9)
+			payload[0] = logTruncate
+			binary.BigEndian.PutUint64(payload[1:], uint64(op.height))
+			data = append(data, encodeLogRecord(payload)...)
+			ops = append(ops, logOp{truncate: op.height})
+			if op.height < height {
+				height = op.height
+			}
+			continue
+		}
+		if op.height != height {
+			return fmt.Errorf("cannot put block %d on top of height %d", op.height, height-1)
+		}
+		payload, err := encodeLogPut(op.block)
+		if err != nil {
+			return err
+		}
+		offset := s.size + int64(len(data)) + 8
+		data = append(data, encodeLogRecord(payload)...)
+		ops = append(ops, logOp{truncate: -1, entry: logEntry{hash: op.block.hash, offset: offset, length: len(payload)}})
+		height++
+	}
+	data = append(data, encodeLogRecord([]byte{logCommit})...)
+	if _, err := s.file.WriteAt(data, s.size); err != nil {
+		return err
+	}
+	if err := s.file.Sync(); err != nil {
+		return err
+	}
+	s.size += int64(len(data))
+	s.apply(ops)
+	batch.ops = nil
+	return nil
+}
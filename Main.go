@@ -1,19 +1,55 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
 
 	ec "github.com/IBentu/CryptoCurrency/EClib"
 )
 
 func main() {
-	runNode()
+	if err := runCommand(os.Args[1:]); err != nil && err != flag.ErrHelp {
+		fmt.Println(err)
+		os.Exit(1)
+	}
 }
 
-// runNode runs the initiates the node and runs it
-func runNode() {
-	config, err := readJSON()
-	checkError(err)
+// runNode runs the initiates the node and runs it until SIGINT or SIGTERM, then stops it gracefully.
+// A data directory without a config.json gets a new one, so several nodes can run side by side from
+// their own data directories and ports
+func runNode(args []string) error {
+	flags := flag.NewFlagSet("node run", flag.ContinueOnError)
+	dataDir := flags.String("datadir", DefaultDataDir, "data directory of the node")
+	p2pPort := flags.Int("p2p-port", 0, "P2P port (default: the config's, or the network's)")
+	httpPort := flags.Int("http-port", 0, "HTTP port (default: the config's, or the network's)")
+	networkName := flags.String("network", "", "network to join (default: the config's)")
+	peers := flags.String("peers", "", "peers to connect to, separated by ';' (default: the config's)")
+	store := flags.String("store", "", "block store, dir or log (default: the config's)")
+	prune := flags.Int("prune", 0, "number of latest blocks a pruned blockchain keeps, 0 to keep every block (default: the config's)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	config, err := readJSON(*dataDir)
+	if os.IsNotExist(err) {
+		fmt.Printf("Creating a new config in %s\n", *dataDir)
+		if err := os.MkdirAll(*dataDir, 0755); err != nil {
+			return err
+		}
+		config = newConfig(*dataDir)
+		err = writeJSON(config)
+	}
+	if err != nil {
+		return err
+	}
+	lock, err := lockDataDir(config.DataDir)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
 	var node Node
 	if config.Node.FirstInit {
 		priv, pub := ec.ECGenerateKey()
@@ -24,6 +60,47 @@ func runNode() {
 		err = writeJSON(config)
 		checkError(err)
 	}
-	node.init(config)
-	select {}
+	if *p2pPort > 0 {
+		config.P2PPort = *p2pPort
+	}
+	if *httpPort > 0 {
+		config.HTTPPort = *httpPort
+	}
+	// the flags override the config of this run only, but the node saves its peers like the ones it learns
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "network":
+			config.Network = *networkName
+		case "peers":
+			config.Peers = *peers
+		case "store":
+			config.Store = *store
+		case "prune":
+			config.Prune = *prune
+		}
+	})
+	network, err := loadNetwork(config.DataDir, config.Network)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Joining the %s network\n", network.Name())
+	node.init(config, network)
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	if err := node.Start(context.Background()); err != nil {
+		node.blockchain.Close()
+		return err
+	}
+	sig := <-signals
+	fmt.Printf("Got %s, stopping the node once the current requests and block are done (again to force)\n", sig)
+	go func() {
+		<-signals
+		fmt.Println("Forced to stop")
+		os.Exit(1)
+	}()
+	if err := node.Stop(); err != nil {
+		return err
+	}
+	fmt.Println("The node stopped")
+	return nil
 }
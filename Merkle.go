@@ -0,0 +1,132 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+const (
+	// merkleLeafTag starts the preimage of a leaf of a Merkle tree
+	merkleLeafTag = 'L'
+	// merkleNodeTag starts the preimage of an interior node of a Merkle tree, so a node can never
+	// pass for a leaf or the other way around
+	merkleNodeTag = 'N'
+)
+
+// MerkleStep is a sibling hash on the path from a transaction to the Merkle root
+type MerkleStep struct {
+	Hash string `json:"hash"`
+	Left bool   `json:"left"` // true if the sibling is on the left of the path
+}
+
+// MerkleProof proves that a transaction is included in a block
+type MerkleProof struct {
+	TxHash    string       `json:"txHash"`
+	BlockHash string       `json:"blockHash"`
+	Steps     []MerkleStep `json:"steps"`
+}
+
+// merkleLeaf returns the leaf of a transaction hash
+func merkleLeaf(txHash string) []byte {
+	sum := sha256.Sum256(append([]byte{merkleLeafTag}, txHash...))
+	return sum[:]
+}
+
+// merkleParent returns the parent node of two nodes
+func merkleParent(left, right []byte) []byte {
+	sum := sha256.Sum256(append(append([]byte{merkleNodeTag}, left...), right...))
+	return sum[:]
+}
+
+// merkleLevels returns every level of the Merkle tree of the transactions, from the leaves to the root.
+// A node without a sibling is moved up a level as is rather than paired with a copy of itself, so no
+// two lists of transactions share a root
+func merkleLevels(transactions []*Transaction) [][][]byte {
+	level := make([][]byte, len(transactions))
+	for i, t := range transactions {
+		level[i] = merkleLeaf(t.hash)
+	}
+	levels := [][][]byte{level}
+	for len(level) > 1 {
+		next := make([][]byte, 0, (len(level)+1)/2)
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i])
+			} else {
+				next = append(next, merkleParent(level[i], level[i+1]))
+			}
+		}
+		levels = append(levels, next)
+		level = next
+	}
+	return levels
+}
+
+// computeMerkleRoot returns the hex encoded Merkle root of the transactions
+func computeMerkleRoot(transactions []*Transaction) string {
+	if len(transactions) == 0 {
+		sum := sha256.Sum256(nil)
+		return hex.EncodeToString(sum[:])
+	}
+	levels := merkleLevels(transactions)
+	return hex.EncodeToString(levels[len(levels)-1][0])
+}
+
+// buildMerkleSteps returns the path from the transaction at position to the Merkle root
+func buildMerkleSteps(transactions []*Transaction, position int) []MerkleStep {
+	steps := []MerkleStep{}
+	levels := merkleLevels(transactions)
+	for _, level := range levels[:len(levels)-1] {
+		sibling := position ^ 1
+		if sibling < len(level) {
+			steps = append(steps, MerkleStep{Hash: hex.EncodeToString(level[sibling]), Left: sibling < position})
+		}
+		position /= 2
+	}
+	return steps
+}
+
+// verifyMerkleSteps checks that the path leads from a transaction hash to the Merkle root
+func verifyMerkleSteps(txHash, root string, steps []MerkleStep) bool {
+	node := merkleLeaf(txHash)
+	for _, step := range steps {
+		sibling, err := hex.DecodeString(step.Hash)
+		if err != nil {
+			return false
+		}
+		if step.Left {
+			node = merkleParent(sibling, node)
+		} else {
+			node = merkleParent(node, sibling)
+		}
+	}
+	return hex.EncodeToString(node) == root
+}
+
+// GetMerkleProof returns a proof that a confirmed transaction is included in its block
+func (bc *Blockchain) GetMerkleProof(txHash string) (*MerkleProof, error) {
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+	loc, ok := bc.txIndex.Locations[txHash]
+	if !ok {
+		return nil, ErrTransactionNotFound
+	}
+	b, err := bc.store.Get(loc.BlockIndex)
+	if err != nil {
+		return nil, err
+	}
+	return &MerkleProof{
+		TxHash:    txHash,
+		BlockHash: b.hash,
+		Steps:     buildMerkleSteps(b.transactions, loc.Position),
+	}, nil
+}
+
+// VerifyMerkleProof checks a proof against the Merkle root of the block it names
+func (bc *Blockchain) VerifyMerkleProof(proof *MerkleProof) (bool, error) {
+	b, err := bc.GetBlockByHash(proof.BlockHash)
+	if err != nil {
+		return false, err
+	}
+	return verifyMerkleSteps(proof.TxHash, b.merkleRoot, proof.Steps), nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+)
+
+const (
+
+	// DefaultInitialSubsidy is the reward of the first blocks
+	DefaultInitialSubsidy = 20
+
+	// DefaultHalvingInterval is the number of blocks between halvings of the reward
+	DefaultHalvingInterval = 100000
+
+	// DefaultMaxSupply is the maximum number of coins the rewards can ever create
+	DefaultMaxSupply = 3800000
+)
+
+// MonetaryPolicy holds the rules the block reward is derived from
+type MonetaryPolicy struct {
+	initialSubsidy  int
+	halvingInterval int
+	maxSupply       int
+}
+
+// newMonetaryPolicy creates a MonetaryPolicy from the config, using the defaults for missing values
+func newMonetaryPolicy(config JSONMonetaryPolicy) *MonetaryPolicy {
+	p := &MonetaryPolicy{
+		initialSubsidy:  config.InitialSubsidy,
+		halvingInterval: config.HalvingInterval,
+		maxSupply:       config.MaxSupply,
+	}
+	if p.initialSubsidy <= 0 {
+		p.initialSubsidy = DefaultInitialSubsidy
+	}
+	if p.halvingInterval <= 0 {
+		p.halvingInterval = DefaultHalvingInterval
+	}
+	if p.maxSupply <= 0 {
+		p.maxSupply = DefaultMaxSupply
+	}
+	return p
+}
+
+// eraSubsidy returns the reward of the blocks in a halving era
+func (p *MonetaryPolicy) eraSubsidy(era int) int {
+	if era >= 63 {
+		return 0
+	}
+	return p.initialSubsidy >> uint(era)
+}
+
+// supplyAt returns the number of coins the rewards created from the origin block up to height
+func (p *MonetaryPolicy) supplyAt(height int) int {
+	supply := 0
+	for era := 0; era*p.halvingInterval < height; era++ {
+		subsidy := p.eraSubsidy(era)
+		if subsidy == 0 {
+			break
+		}
+		blocks := height - era*p.halvingInterval
+		if blocks > p.halvingInterval {
+			blocks = p.halvingInterval
+		}
+		supply += blocks * subsidy
+		if supply >= p.maxSupply {
+			return p.maxSupply
+		}
+	}
+	return supply
+}
+
+// subsidy returns the reward of the block at height, which never takes the supply over maxSupply
+func (p *MonetaryPolicy) subsidy(height int) int {
+	if height <= 0 {
+		return 0
+	}
+	subsidy := p.eraSubsidy((height - 1) / p.halvingInterval)
+	if left := p.maxSupply - p.supplyAt(height-1); subsidy > left {
+		subsidy = left
+	}
+	return subsidy
+}
+
+// Subsidy returns the reward of the block at the specified index
+func (bc *Blockchain) Subsidy(index int) int {
+	return bc.policy.subsidy(index)
+}
+
+// GetSupply returns the number of coins in circulation at the specified index, which are the
+// premine of the origin block and the rewards since
+func (bc *Blockchain) GetSupply(index int) (int, error) {
+	if index < 0 || index > bc.GetLatestIndex() {
+		return 0, errors.New("Index Out of Bounds")
+	}
+	return bc.network.premine() + bc.policy.supplyAt(index), nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path"
+)
+
+const (
+	// Mainnet is the name of the main network
+	Mainnet = "mainnet"
+	// Testnet is the name of the public test network
+	Testnet = "testnet"
+	// Regtest is the name of the local network for tests, where blocks are mined instantly
+	Regtest = "regtest"
+)
+
+const (
+
+	// DefaultDataDir is the data directory of a node that isn't given one, relative to the working
+	// directory
+	DefaultDataDir = "Config"
+	// NetworksDir is the directory of a data directory the custom network profiles are saved in, as
+	// <name>.json
+	NetworksDir = "Networks"
+)
+
+var (
+	// ErrUnknownNetwork is returned for a network that has no built-in or custom profile
+	ErrUnknownNetwork = errors.New("Unknown network")
+)
+
+// Network is the profile of a network: its genesis block, consensus rules and ports. Nodes of
+// different networks tell each other apart by the magic of their packets
+type Network struct {
+	name        string
+	magic       uint32
+	p2pPort     int
+	httpPort    int
+	genesis     *Block
+	difficulty  JSONDifficulty
+	policy      JSONMonetaryPolicy
+	consensus   JSONConsensus
+	checkpoints map[int]string
+}
+
+// builtinNetwork returns the profile of a network that ships with the node
+func builtinNetwork(name string) (*Network, error) {
+	switch name {
+	case Mainnet:
+		// mined once by the genesis command, so it isn't mined again on every start
+		genesis := &Block{
+			index:        0,
+			timestamp:    1530403200000,
+			miner:        "IBentu CryptoCurrency mainnet",
+			transactions: []*Transaction{},
+			merkleRoot:   "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+			difficulty:   DefaultInitialDifficulty,
+			nuance:       big.NewInt(1124383),
+			hash:         "00000a823376c6caa8096da63a85c4b48170a19af0181ae552db5580dee7f16a",
+		}
+		return &Network{
+			name:       Mainnet,
+			magic:      0x49424e54,
+			p2pPort:    4415,
+			httpPort:   4416,
+			genesis:    genesis,
+			difficulty: JSONDifficulty{DefaultInitialDifficulty, DefaultTargetBlockTime, DefaultRetargetWindow},
+			policy:     JSONMonetaryPolicy{DefaultInitialSubsidy, DefaultHalvingInterval, DefaultMaxSupply},
+			checkpoints: map[int]string{
+				0: genesis.hash,
+			},
+		}, nil
+	case Testnet:
+		return &Network{
+			name:       Testnet,
+			magic:      0x49425453,
+			p2pPort:    14415,
+			httpPort:   14416,
+			genesis:    newGenesisBlock(1514764800000, "testnet", 0, nil),
+			difficulty: JSONDifficulty{16, DefaultTargetBlockTime, DefaultRetargetWindow},
+			policy:     JSONMonetaryPolicy{DefaultInitialSubsidy, DefaultHalvingInterval, DefaultMaxSupply},
+		}, nil
+	case Regtest:
+		// a single leading zero bit and a window that is never reached, so every block is mined instantly
+		return &Network{
+			name:       Regtest,
+			magic:      0x49425247,
+			p2pPort:    24415,
+			httpPort:   24416,
+			genesis:    newGenesisBlock(1514851200000, "regtest", 0, nil),
+			difficulty: JSONDifficulty{1, 1, 1 << 30},
+			policy:     JSONMonetaryPolicy{50, 150, 15000},
+		}, nil
+	}
+	return nil, ErrUnknownNetwork
+}
+
+// networkPath returns the path of the profile file of a custom network in a data directory
+func networkPath(dataDir, name string) string {
+	return path.Join(dataDir, NetworksDir, name+".json")
+}
+
+// loadNetwork returns the profile of the network with the received name, from the Networks
+// directory of a data directory if there is one there and from the built-in profiles otherwise.
+// An empty name is the Mainnet
+func loadNetwork(dataDir, name string) (*Network, error) {
+	if name == "" {
+		name = Mainnet
+	}
+	dir := networkPath(dataDir, name)
+	data, err := ioutil.ReadFile(dir)
+	if os.IsNotExist(err) {
+		return builtinNetwork(name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	n := &Network{}
+	if err := json.Unmarshal(data, n); err != nil {
+		return nil, fmt.Errorf("invalid profile of network %s: %s", name, err)
+	}
+	if n.name != name {
+		return nil, fmt.Errorf("the profile in %s is of network %s", dir, n.name)
+	}
+	if n.genesis == nil {
+		return nil, fmt.Errorf("the profile of network %s has no origin block", name)
+	}
+	if err := validateGenesis(n.genesis); err != nil {
+		return nil, fmt.Errorf("invalid origin block of network %s: %s", name, err)
+	}
+	return n, nil
+}
+
+// save writes the profile to Networks/<name>.json in a data directory
+func (n *Network) save(dataDir string) error {
+	dir := networkPath(dataDir, n.name)
+	data, err := json.MarshalIndent(n, "", "    ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(path.Dir(dir), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(dir, data, 0644)
+}
+
+// dataDir returns the directory the blockchain of the network is kept in under a data directory.
+// The Mainnet keeps it in the data directory itself and every other network in <name>/
+func (n *Network) dataDir(base string) string {
+	if base == "" {
+		base = DefaultDataDir
+	}
+	if n.name == Mainnet {
+		return base
+	}
+	return path.Join(base, n.name)
+}
+
+// Name returns the name of the network
+func (n *Network) Name() string {
+	return n.name
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"math"
 	"math/big"
 	"sync"
 	"time"
@@ -16,6 +18,12 @@ type Node struct {
 	blockchain      *Blockchain
 	transactionPool *TransactionPool
 	server          *NodeServer
+	reorgEvents     chan *ReorgEvent
+	dataDir         string
+	mining          bool
+	ctx             context.Context
+	cancel          context.CancelFunc
+	wg              *sync.WaitGroup
 	mutex           *sync.Mutex
 }
 
@@ -28,23 +36,76 @@ const (
 	// SaveInterval is the save time interval (in seconds)
 	// of the blockchain and peers
 	SaveInterval = 20
+
+	// ReorgEventsBuffer is the number of reorg events that can wait to be handled
+	ReorgEventsBuffer = 16
 )
 
-// init initiates the Node by loading a json settings file
-func (n *Node) init(config *JSONConfig) {
+// init initiates the Node by loading a json settings file. Nothing runs until Start is called
+func (n *Node) init(config *JSONConfig, network *Network) {
 	n.mutex = &sync.Mutex{}
+	n.wg = &sync.WaitGroup{}
+	n.dataDir = config.DataDir
 	n.privKey = config.Node.PrivateKey
 	n.pubKey = config.Node.PublicKey
 	n.server = &NodeServer{}
-	n.server.init(n, config)
+	n.server.init(n, config, network)
 	n.blockchain = &Blockchain{}
-	n.blockchain.init()
+	n.blockchain.init(network, config)
 	n.transactionPool = &TransactionPool{}
 	n.transactionPool.init()
+	n.reorgEvents = make(chan *ReorgEvent, ReorgEventsBuffer)
+}
+
+// Start runs the NodeServer and the periodic updates and saves of the node until ctx is done or
+// Stop is called
+func (n *Node) Start(ctx context.Context) error {
+	n.ctx, n.cancel = context.WithCancel(ctx)
+	if err := n.server.Start(n.ctx); err != nil {
+		n.cancel()
+		return err
+	}
+	n.wg.Add(1)
+	go n.handleReorgEvents()
 	n.updateFromPeers()
-	go n.periodicSave()
+	n.periodicSave()
 	fmt.Println("The node is up!")
 	n.PrintBlockchain()
+	return nil
+}
+
+// Stop stops the node: it stops accepting connections and mining, waits for the requests being
+// handled, the block being mined and the running updates, then saves the config and the
+// blockchain and closes the block store
+func (n *Node) Stop() error {
+	n.cancel()
+	n.stopMining()
+	n.server.Stop()
+	n.wg.Wait()
+	if err := n.saveConfig(); err != nil {
+		fmt.Printf("could not save config, error:\n	%s\n", err)
+	}
+	err := n.blockchain.saveBlockchain()
+	if cerr := n.blockchain.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// every runs fn right away and then every interval in a goroutine, until the node stops
+func (n *Node) every(interval time.Duration, fn func()) {
+	n.wg.Add(1)
+	go func() {
+		defer n.wg.Done()
+		for {
+			fn()
+			select {
+			case <-n.ctx.Done():
+				return
+			case <-time.After(interval):
+			}
+		}
+	}()
 }
 
 // PrintBlockchain Prints the hashed of the blockchain
@@ -54,7 +115,7 @@ func (n *Node) PrintBlockchain() {
 
 // saveConfig saves the node's data in the config file
 func (n *Node) saveConfig() error {
-	config, err := readJSON()
+	config, err := readJSON(n.dataDir)
 	if err != nil {
 		return err
 	}
@@ -65,111 +126,237 @@ func (n *Node) saveConfig() error {
 	return writeJSON(config)
 }
 
-// verifyTransaction checks the blockchain if the transaction is legal (enough credits to send), and verifies the transactionSign, and also double spending
-func (n *Node) verifyTransaction(t *Transaction) bool {
-	signed := ec.ECVerify(t.hash, t.sign, t.senderKey)
-	hash := ec.ECHashString(t.toHashString())
-	validHash := hash == t.hash
-	validBalance := t.amount <= n.checkBalance(t.senderKey)
-	noDoubleSpending := !n.blockchain.DoesTransactionExist(t)
-	return signed && validBalance && noDoubleSpending && validHash
+// verifyTransaction checks the blockchain and the TransactionPool if the transaction is legal as the next
+// pending transaction of its sender (a positive amount, the next nonce, enough credits to send after the
+// pending transactions), and verifies the transactionSign, its timestamp, and also double spending.
+// It returns the reason an illegal transaction is rejected
+func (n *Node) verifyTransaction(t *Transaction) error {
+	if t.isCoinbase() || !t.verifySignature() {
+		return fmt.Errorf("invalid hash or signature")
+	}
+	if err := n.blockchain.ConsensusParams().checkTransactionTime(t, GetCurrentMillis()); err != nil {
+		return err
+	}
+	if t.amount <= 0 {
+		return fmt.Errorf("non-positive amount")
+	}
+	if t.fee < 0 {
+		return fmt.Errorf("negative fee")
+	}
+	nonce, spent := n.transactionPool.pendingFrom(t.senderKey, n.blockchain.GetNonce(t.senderKey))
+	if t.nonce != nonce {
+		return fmt.Errorf("expected nonce %d, got %d", nonce, t.nonce)
+	}
+	// the pending transactions may spend more than the balance after a reorg, and a negative balance
+	// minus the fee could overflow
+	if balance := n.checkBalance(t.senderKey) - spent; balance < 0 || t.amount > balance-t.fee {
+		return fmt.Errorf("sender balance %d can't pay an amount of %d and a fee of %d", balance, t.amount, t.fee)
+	}
+	if n.blockchain.DoesTransactionExist(t) {
+		return fmt.Errorf("transaction already exists")
+	}
+	return nil
+}
+
+// nextNonce returns the nonce the next transaction of a certain PublicKey must have, counting its
+// pending transactions
+func (n *Node) nextNonce(key string) int {
+	nonce, _ := n.transactionPool.pendingFrom(key, n.blockchain.GetNonce(key))
+	return nonce
 }
 
 // mine creates a block using the TransactionPool, returns true if a block was created and false otherwise
 func (n *Node) mine() bool {
 	var block Block
+	params := n.blockchain.ConsensusParams()
 	block.miner = n.pubKey
-	transactionsToMake := make([]*Transaction, 0)
-	for n.transactionPool.length() > 0 && len(transactionsToMake) < 5 {
-		t := n.transactionPool.remove()
-		if n.verifyTransaction(t) {
-			transactionsToMake = append(transactionsToMake, t)
-		}
-	}
-	block.transactions = transactionsToMake
-	block.timestamp = GetCurrentMillis()
 	block.index = n.blockchain.GetLatestIndex() + 1
+	block.timestamp = GetCurrentMillis()
+	if mtp := n.blockchain.MedianTimePast(); block.timestamp <= mtp {
+		block.timestamp = mtp + 1 // the local clock is behind the network
+	}
 	block.prevHash = n.blockchain.GetLatestHash()
+	block.difficulty = n.blockchain.NextDifficulty()
+	transactionsToMake, fees := n.assembleTransactions(&block, params)
+	coinbase := newCoinbase(block.miner, n.blockchain.Subsidy(block.index)+fees, block.index, block.timestamp)
+	block.transactions = append([]*Transaction{coinbase}, transactionsToMake...)
+	block.merkleRoot = computeMerkleRoot(block.transactions)
 	var counter int64
 	for {
 		block.nuance = big.NewInt(counter)
 		counter++
 		block.updateHash()
 		if block.verifyPOW() {
-			if n.blockchain.IsBlockValid(block) { // incase the blockchain was updated while mining
+			if err := params.checkBlockLimits(&block); err != nil {
+				fmt.Println(err)
+				n.transactionPool.addTransactions(transactionsToMake)
+				return false
+			}
+			if err := n.blockchain.AddBlock(&block); err != nil {
+				if err != ErrNotOnTop { // the blockchain may have been updated while mining
+					fmt.Println(err)
+				}
 				n.transactionPool.addTransactions(transactionsToMake)
 				return false
 			}
-			n.blockchain.AddBlock(&block)
 			n.PrintBlockchain()
 			return true
 		}
 	}
 }
 
-// checkBalance goes through the blockchain, checks and returns the balance of a certain PublicKey
-func (n *Node) checkBalance(key string) int {
-	sum := 0
-	for i := 1; i < n.blockchain.Length(); i++ {
-		currBlock := n.blockchain.GetBlock(i)
-		if currBlock.miner == key {
-			sum += 20
+// startMining mines blocks one after another in a goroutine until stopMining is called or the node
+// stops. It returns false if the node is already mining or is stopping
+func (n *Node) startMining() bool {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if n.mining || n.ctx.Err() != nil {
+		return false
+	}
+	n.mining = true
+	n.wg.Add(1)
+	go func() {
+		defer n.wg.Done()
+		for n.isMining() && n.ctx.Err() == nil {
+			n.mine()
+		}
+	}()
+	return true
+}
+
+// stopMining stops the mining started by startMining once the block being mined is done. It
+// returns false if the node isn't mining
+func (n *Node) stopMining() bool {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	mining := n.mining
+	n.mining = false
+	return mining
+}
+
+// isMining checks if the node mines blocks one after another
+func (n *Node) isMining() bool {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.mining
+}
+
+// assembleTransactions takes the valid transactions with the highest fee rate from the TransactionPool,
+// as many as fit the consensus limits next to the header and coinbase of block, and returns them with
+// the sum of their fees. The transactions of every sender are taken in nonce order and must be affordable
+// together. Invalid transactions are dropped from the pool
+func (n *Node) assembleTransactions(block *Block, params *ConsensusParams) ([]*Transaction, int) {
+	// the size of the block without transactions, with the widest coinbase and nuance it may end up with
+	template := *block
+	template.transactions = []*Transaction{newCoinbase(block.miner, int(^uint(0)>>1), block.index, block.timestamp)}
+	template.merkleRoot = computeMerkleRoot(template.transactions)
+	template.nuance = big.NewInt(math.MaxInt64)
+	template.updateHash()
+	space := params.maxBlockBytes - template.size()
+	state := n.blockchain.GetAccountState()
+	candidates := n.transactionPool.byFeeRate()
+	transactionsToMake := make([]*Transaction, 0)
+	toRemove := make([]*Transaction, 0)
+	size, fees := 0, 0
+	for picked := true; picked && len(transactionsToMake)+1 < params.maxTransactions; {
+		picked = false
+		for i, t := range candidates {
+			// every transaction after the coinbase is preceded by a comma
+			if t.nonce > state.nonce(t.senderKey) || size+t.size()+1 > space {
+				continue // waits for an earlier nonce of its sender, or doesn't fit
+			}
+			candidates = append(candidates[:i], candidates[i+1:]...)
+			toRemove = append(toRemove, t)
+			if params.checkTransactionTime(t, block.timestamp) == nil && validateTransaction(t, state, n.blockchain.IsConfirmed, true) == nil {
+				state.connectTransaction(t)
+				size += t.size() + 1
+				fees += t.fee
+				transactionsToMake = append(transactionsToMake, t)
+			}
+			picked = true
+			break
 		}
-		for j := 0; j < len(currBlock.transactions); j++ {
-			if currBlock.transactions[j].senderKey == key {
-				sum -= currBlock.transactions[j].amount
-			} else if currBlock.transactions[j].recipientKey == key {
-				sum += currBlock.transactions[j].amount
+	}
+	n.transactionPool.removeTransactions(toRemove)
+	return transactionsToMake, fees
+}
+
+// reorganize switches the blockchain to a branch of headers whose blocks are requested with fetch,
+// removes the transactions the new blocks confirmed from the TransactionPool, returns the
+// still-valid transactions of the disconnected blocks to it and emits a ReorgEvent
+func (n *Node) reorganize(headers []*BlockHeader, fetch func(index, count int) ([]*Block, error)) error {
+	event, err := n.blockchain.SwitchBranch(headers, fetch)
+	if err != nil {
+		return err
+	}
+	n.transactionPool.removeConfirmed(n.blockchain.IsConfirmed)
+	for _, b := range event.Disconnected {
+		for _, t := range b.transactions {
+			if !n.transactionPool.DoesExists(t) && n.verifyTransaction(t) == nil {
+				n.transactionPool.addTransaction(t)
 			}
 		}
 	}
-	return sum
+	if event.Depth > 0 {
+		select {
+		case n.reorgEvents <- event:
+		default:
+			fmt.Println("Dropped a reorg event, too many are waiting")
+		}
+	}
+	return nil
+}
+
+// handleReorgEvents recieves the ReorgEvents of the node and reports them until the node stops
+func (n *Node) handleReorgEvents() {
+	defer n.wg.Done()
+	for {
+		select {
+		case event := <-n.reorgEvents:
+			fmt.Printf("Reorganized the blockchain from index %d, depth %d:\n    Old top: %s\n    New top: %s\n",
+				event.ForkIndex, event.Depth, event.OldTip, event.NewTip)
+		case <-n.ctx.Done():
+			return
+		}
+	}
+}
+
+// checkBalance returns the balance of a certain PublicKey from the account state of the blockchain
+func (n *Node) checkBalance(key string) int {
+	return n.blockchain.GetBalance(key)
 }
 
 // makeTransaction create a transaction adds it to the pool and returns true if transaction is legal,
 // otherwise it returns false
-func (n *Node) makeTransaction(recipient string, amount int) bool {
+func (n *Node) makeTransaction(recipient string, amount, fee int) bool {
 	var t Transaction
 	cb := n.checkBalance(n.pubKey)
-	if amount > cb {
+	if fee < 0 || amount+fee > cb {
 		return false
 	}
 	t.amount = amount
+	t.fee = fee
+	t.nonce = n.nextNonce(n.pubKey)
 	t.recipientKey = recipient
 	t.senderKey = n.pubKey
 	t.timestamp = GetCurrentMillis()
-	t.hash = ec.ECHashString(t.toHashString())
+	t.hash = t.computeHash()
 	t.sign = ec.ECSign(t.hash, n.privKey, n.pubKey)
 	n.transactionPool.addTransaction(&t)
 	return true
 }
 
 // updateFromPeers updates the blockchain, peers and transactions from
-// the peer-nodes.
+// the peer-nodes until the node stops.
 func (n *Node) updateFromPeers() {
-	go func() {
-		for {
-			n.server.requestBlockchain()
-			time.Sleep(time.Second * UpdateInterval)
-		}
-	}()
-	go func() {
-		for {
-			n.server.requestPeers()
-			time.Sleep(time.Second * UpdateInterval)
-		}
-	}()
-	go func() {
-		for {
-			n.server.requestPool()
-			time.Sleep(time.Second * UpdateInterval)
-		}
-	}()
+	n.every(time.Second*UpdateInterval, n.server.requestBlockchain)
+	n.every(time.Second*UpdateInterval, n.server.requestPeers)
+	n.every(time.Second*UpdateInterval, n.server.requestPool)
 }
 
-// periodicSave saves the blockchain and the config every 30 seconds
+// periodicSave saves the blockchain and the config every SaveInterval seconds until the node stops
 func (n *Node) periodicSave() {
-	for {
+	n.every(time.Second*SaveInterval, func() {
 		err1 := n.saveConfig()
 		err2 := n.blockchain.saveBlockchain()
 		if err1 != nil {
@@ -178,6 +365,5 @@ func (n *Node) periodicSave() {
 		if err2 != nil {
 			fmt.Println(err2)
 		}
-		time.Sleep(time.Second * SaveInterval)
-	}
+	})
 }
@@ -1,7 +1,13 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"math/big"
+	"net"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 )
@@ -13,51 +19,77 @@ type NodeServer struct {
 	mutex        *sync.Mutex
 	communicator *Communicator
 	webServer    *WebServer
+	network      *Network
+	p2pPort      int
+	httpPort     int
 	recvChannel  chan *Packet
 	sendChannel  chan *Packet
+	handled      chan struct{}
 }
 
-const (
-
-	// ListenPort is the port on which the Server is listening to
-	ListenPort = 4415
-)
-
-// init initiates the NodeServer and runs the listener of the WebServer and the Communicator
-func (n *NodeServer) init(node *Node, config *JSONConfig) {
+// init initiates the NodeServer, its WebServer and its Communicator. The ports of the config take
+// precedence over the network's
+func (n *NodeServer) init(node *Node, config *JSONConfig, network *Network) {
 	n.node = node
-	n.mutex = &sync.Mutex{}
-	n.peers = []string{}
-	peerStr := config.Peers
-	splat := strings.Split(peerStr, ";")
-	for i := 0; i < len(splat); i++ {
-		splat[i] = strings.TrimSpace(splat[i])
+	n.network = network
+	n.p2pPort = network.p2pPort
+	if config.P2PPort > 0 {
+		n.p2pPort = config.P2PPort
 	}
-	if len(splat) > 0 {
-		if splat[0] != "" {
-			n.peers = append(node.server.peers, splat...)
-		}
+	n.httpPort = network.httpPort
+	if config.HTTPPort > 0 {
+		n.httpPort = config.HTTPPort
 	}
-	n.webServer = &WebServer{server: n}
+	n.mutex = &sync.Mutex{}
+	n.webServer = &WebServer{server: n, mutex: &sync.Mutex{}, seen: map[int64]bool{}}
 	n.recvChannel = make(chan *Packet)
 	n.sendChannel = make(chan *Packet)
-	n.communicator = NewCommunicator(n, config.Addr, n.recvChannel, n.sendChannel, ListenPort)
-	go n.communicator.Listen()
-	go n.webServer.Start()
+	n.communicator = NewCommunicator(n, net.JoinHostPort(config.Addr, strconv.Itoa(n.p2pPort)), n.recvChannel, n.sendChannel, n.p2pPort, network.magic)
+	n.peers = []string{}
+	for _, peer := range strings.Split(config.Peers, ";") {
+		if peer = n.peerAddress(strings.TrimSpace(peer)); peer != "" && !n.doesPeerExist(peer) && !n.isSelf(peer) {
+			n.peers = append(n.peers, peer)
+		}
+	}
+}
+
+// Start runs the listeners of the Communicator and the WebServer until ctx is done or Stop is called
+func (n *NodeServer) Start(ctx context.Context) error {
+	n.handled = make(chan struct{})
 	go n.handlePackets()
+	if err := n.communicator.Start(ctx); err != nil {
+		close(n.recvChannel)
+		return err
+	}
+	if err := n.webServer.Start(ctx); err != nil {
+		n.communicator.Stop()
+		close(n.recvChannel)
+		return err
+	}
+	return nil
+}
+
+// Stop stops the listeners of the WebServer and the Communicator and waits for the requests they
+// are handling
+func (n *NodeServer) Stop() {
+	n.webServer.Stop()
+	n.communicator.Stop()
+	close(n.recvChannel)
+	<-n.handled
 }
 
 // handlePackets recieves a packet through the recieve channel and returns a packet through the send
-// channel that complies with the request
+// channel that complies with the request, until the recieve channel is closed
 func (n *NodeServer) handlePackets() {
-	for {
-		p := <-n.recvChannel
+	defer close(n.handled)
+	for p := range n.recvChannel {
 		retP := &Packet{requestType: ""}
 		switch p.Type() {
 		case TPR:
 			retP = NewPacket(STPM, n.node.transactionPool.FormatSTPM())
 		case BR:
-			retP = NewPacket(SCM, FormatSCM(n.node.blockchain.GetLatestIndex(), n.node.blockchain.GetLatestHash()))
+			retP = NewPacket(SCM, FormatSCM(n.node.blockchain.GetLatestIndex(), n.node.blockchain.GetLatestHash(),
+				n.node.blockchain.TotalWork(), n.node.blockchain.Pruned()))
 		case PR:
 			retP = NewPacket(PA, FormatPA(n.peers))
 		case FT:
@@ -74,8 +106,30 @@ func (n *NodeServer) handlePackets() {
 				if err != nil {
 					break
 				}
-				retP = NewPacket(BP, FormatBP(n.node.blockchain.GetBlocksFromIndex(index)))
+				blocks, err := n.node.blockchain.GetBlocksFromIndex(index)
+				if err != nil {
+					break
+				}
+				retP = NewPacket(BP, FormatBP(blocks))
+			}
+		case HR:
+			index, count, err := UnformatHR(p.data)
+			if err != nil {
+				break
+			}
+			if count > MaxHeadersPerPacket {
+				count = MaxHeadersPerPacket
+			}
+			retP = NewPacket(HP, FormatHP(n.node.blockchain.GetHeaders(index, count)))
+		case BRR:
+			index, count, err := UnformatBRR(p.data)
+			if err != nil {
+				break
+			}
+			if count > MaxBlocksPerPacket {
+				count = MaxBlocksPerPacket
 			}
+			retP = NewPacket(BP, FormatBP(n.node.blockchain.GetBlocks(index, count)))
 		default:
 		}
 		n.sendChannel <- retP
@@ -87,6 +141,15 @@ func (n *NodeServer) Address() string {
 	return n.communicator.Address()
 }
 
+// peerAddress returns the host:port address of a peer, completing a bare host with the P2P port of
+// the network
+func (n *NodeServer) peerAddress(peer string) string {
+	if _, _, err := net.SplitHostPort(peer); err == nil || peer == "" {
+		return peer
+	}
+	return net.JoinHostPort(peer, strconv.Itoa(n.network.p2pPort))
+}
+
 // doesPeerExist checks if the recieved peer is already in the NodeServer peers
 func (n *NodeServer) doesPeerExist(peer string) bool {
 	for _, addr := range n.peers {
@@ -110,10 +173,14 @@ func (n *NodeServer) savePeer(config *JSONConfig, peer string) {
 	confPeers := config.Peers
 	splat := strings.Split(confPeers, ";")
 	for _, confPeer := range splat {
-		if confPeer == peer {
+		if n.peerAddress(strings.TrimSpace(confPeer)) == peer {
 			return
 		}
 	}
+	if strings.TrimSpace(confPeers) == "" {
+		config.Peers = peer
+		return
+	}
 	config.Peers += fmt.Sprintf(";%s", peer)
 }
 
@@ -127,7 +194,8 @@ func (n *NodeServer) addPeers(peers []string) {
 // addPeer adds the recieved peer to the node of if the peer doesn't already exist and it isn't the address
 // of the current node
 func (n *NodeServer) addPeer(peer string) {
-	if !n.doesPeerExist(peer) && peer != n.Address() {
+	peer = n.peerAddress(peer)
+	if peer != "" && !n.doesPeerExist(peer) && !n.isSelf(peer) {
 		n.mutex.Lock()
 		n.peers = append(n.peers, peer)
 		fmt.Printf("%s is a new peer\n", peer)
@@ -135,60 +203,241 @@ func (n *NodeServer) addPeer(peer string) {
 	}
 }
 
-// requestBlockchain send a request for the blockchain to every the node knows
+// isSelf checks if a peer address is an address of the current node. A node that listens on every
+// interface is also reached on its P2P port at the loopback addresses and at the addresses of its
+// interfaces
+func (n *NodeServer) isSelf(peer string) bool {
+	if peer == n.Address() {
+		return true
+	}
+	host, port, err := net.SplitHostPort(peer)
+	if err != nil || port != strconv.Itoa(n.p2pPort) {
+		return false
+	}
+	if listen, _, err := net.SplitHostPort(n.Address()); err != nil || (listen != "" && !net.ParseIP(listen).IsUnspecified()) {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	if ip.IsLoopback() || ip.IsUnspecified() {
+		return true
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// removePeer removes the recieved peer from the node and from its config, so it isn't loaded again.
+// It returns false if the node doesn't know the peer
+func (n *NodeServer) removePeer(peer string) (bool, error) {
+	peer = n.peerAddress(peer)
+	n.mutex.Lock()
+	found := false
+	peers := make([]string, 0, len(n.peers))
+	for _, addr := range n.peers {
+		if addr == peer {
+			found = true
+		} else {
+			peers = append(peers, addr)
+		}
+	}
+	n.peers = peers
+	n.mutex.Unlock()
+	if !found {
+		return false, nil
+	}
+	config, err := readJSON(n.node.dataDir)
+	if err != nil {
+		return true, err
+	}
+	confPeers := []string{}
+	for _, confPeer := range strings.Split(config.Peers, ";") {
+		if confPeer = strings.TrimSpace(confPeer); confPeer != "" && n.peerAddress(confPeer) != peer {
+			confPeers = append(confPeers, confPeer)
+		}
+	}
+	config.Peers = strings.Join(confPeers, ";")
+	return true, writeJSON(config)
+}
+
+// Peers returns the peers the node knows
+func (n *NodeServer) Peers() []string {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return append([]string{}, n.peers...)
+}
+
+// branch is a chain of headers offered by a peer, starting at a block the blockchain has
+type branch struct {
+	peer    string
+	headers []*BlockHeader
+	work    *big.Int
+}
+
+// requestBlockchain syncs the blockchain headers-first: it downloads and validates the headers of
+// every peer that claims more work, picks the branch with the most work and only then switches to
+// that branch, requesting its blocks a chunk at a time
 func (n *NodeServer) requestBlockchain() {
+	var best *branch
 	for _, peer := range n.peers {
-		p := NewPacket(BR, []byte{})
-		p, err := n.communicator.SR1(peer, p)
+		br, err := n.requestHeaders(peer)
 		if err != nil {
+			fmt.Printf("Could not get the headers from %s: %s\n", peer, err)
 			continue
 		}
-		if p.Type() != SCM {
-			continue
+		if br != nil && (best == nil || br.work.Cmp(best.work) > 0) {
+			best = br
 		}
-		index, _, err := UnformatSCM(p.data)
+	}
+	if best == nil || n.node.blockchain.IsUpdating() {
+		return
+	}
+	n.node.blockchain.SetUpdating(true)
+	err := n.node.reorganize(best.headers, func(index, count int) ([]*Block, error) {
+		return n.requestBlocks(best.peer, index, count)
+	})
+	n.node.blockchain.SetUpdating(false)
+	if err != nil {
+		fmt.Printf("Did not switch to the blockchain from %s: %s\n", best.peer, err)
+		return
+	}
+	fmt.Printf("Updated blockchain from %s\n", best.peer)
+	n.node.PrintBlockchain()
+}
+
+// requestHeaders requests the headers of a peer from the latest block it shares with the blockchain
+// up to its top block, and validates every chunk of them before it requests the next. It returns
+// nil if the peer doesn't claim more work than the blockchain
+func (n *NodeServer) requestHeaders(peer string) (*branch, error) {
+	p, err := n.communicator.SR1(peer, NewPacket(BR, []byte{}))
+	if err != nil {
+		return nil, err
+	}
+	if p.Type() != SCM {
+		return nil, ErrPacketType
+	}
+	top, _, work, pruned, err := UnformatSCM(p.data)
+	if err != nil {
+		return nil, err
+	}
+	if work.Cmp(n.node.blockchain.TotalWork()) <= 0 {
+		return nil, nil
+	}
+	fork, err := n.findFork(peer, top)
+	if err != nil {
+		return nil, err
+	}
+	if fork < top && fork+1 < pruned {
+		return nil, fmt.Errorf("the peer pruned the blocks below index %d", pruned)
+	}
+	chain := n.node.blockchain.GetHeaders(0, fork+1)
+	for index := fork + 1; index <= top; {
+		chunk, err := n.requestHeaderRange(peer, index, top)
 		if err != nil {
-			continue
+			return nil, err
 		}
-		if index <= n.node.blockchain.GetLatestIndex() {
-			continue
-		}
-		p = NewPacket(FT, FormatFT(index-n.node.blockchain.GetLatestIndex()))
-		p, err = n.communicator.SR1(peer, p)
-		if err != nil {
-			continue
+		if chain, err = n.node.blockchain.ValidateHeaders(chain, chunk); err != nil {
+			return nil, err
 		}
-		if p.Type() != BP {
-			continue
+		index += len(chunk)
+	}
+	work = headersWork(chain)
+	if work.Cmp(n.node.blockchain.TotalWork()) <= 0 {
+		return nil, nil
+	}
+	return &branch{peer: peer, headers: chain[fork:], work: work}, nil
+}
+
+// findFork returns the index of the latest block a peer with the received top block shares with the
+// blockchain. It searches back from the lower of both tops, a chunk of headers at a time, and gives
+// up after MaxForkSearch headers
+func (n *NodeServer) findFork(peer string, top int) (int, error) {
+	last := n.node.blockchain.GetLatestIndex()
+	if top < last {
+		last = top
+	}
+	for searched := 0; searched < MaxForkSearch; {
+		index := last - MaxHeadersPerPacket + 1
+		if index < 0 {
+			index = 0
 		}
-		blocks, err := UnformatBP(p.data)
+		chunk, err := n.requestHeaderRange(peer, index, last)
 		if err != nil {
-			continue
+			return 0, err
 		}
-		allBlocks := blocks
-		for !n.node.blockchain.CompareBlockchains(blocks) {
-			p = NewPacket(IS, FormatIS(blocks[0].index))
-			p, err = n.communicator.SR1(peer, p)
-			if err != nil {
-				continue
+		for i := len(chunk) - 1; i >= 0; i-- {
+			if n.node.blockchain.HasHeader(chunk[i]) {
+				return chunk[i].index, nil
 			}
-			if p.Type() != BP {
-				continue
-			}
-			blocks, err = UnformatBP(p.data)
-			if err != nil {
-				continue
-			}
-			allBlocks = append(blocks, allBlocks...)
 		}
-		if !n.node.blockchain.IsUpdating() {
-			n.node.blockchain.SetUpdating(true)
-			n.node.blockchain.ReplaceBlocks(allBlocks)
-			n.node.blockchain.SetUpdating(false)
-			fmt.Printf("Updated blockchain from %s\n", peer)
-			n.node.PrintBlockchain()
+		if index == 0 {
+			return 0, errors.New("the peer's blockchain has a different origin")
+		}
+		searched += len(chunk)
+		last = index - 1
+	}
+	return 0, fmt.Errorf("the peer's blockchain forks more than %d blocks below ours", MaxForkSearch)
+}
+
+// requestHeaderRange requests the headers of a peer from index up to index last, or as many of them
+// as fit in a single packet, and checks the peer sent that range
+func (n *NodeServer) requestHeaderRange(peer string, index, last int) ([]*BlockHeader, error) {
+	count := last - index + 1
+	if count > MaxHeadersPerPacket {
+		count = MaxHeadersPerPacket
+	}
+	p, err := n.communicator.SR1(peer, NewPacket(HR, FormatHR(index, count)))
+	if err != nil {
+		return nil, err
+	}
+	if p.Type() != HP {
+		return nil, ErrPacketType
+	}
+	chunk, err := UnformatHP(p.data)
+	if err != nil {
+		return nil, err
+	}
+	if len(chunk) != count {
+		return nil, errors.New("the peer sent an unexpected range of headers")
+	}
+	for i, h := range chunk {
+		if h.index != index+i {
+			return nil, errors.New("the peer sent an unexpected range of headers")
 		}
 	}
+	return chunk, nil
+}
+
+// requestBlocks requests up to count blocks of a peer from the specified index up. The peer may
+// send fewer blocks than requested
+func (n *NodeServer) requestBlocks(peer string, index, count int) ([]*Block, error) {
+	p, err := n.communicator.SR1(peer, NewPacket(BRR, FormatBRR(index, count)))
+	if err != nil {
+		return nil, err
+	}
+	if p.Type() != BP {
+		return nil, ErrPacketType
+	}
+	blocks, err := UnformatBP(p.data)
+	if err != nil {
+		return nil, err
+	}
+	if len(blocks) == 0 {
+		return nil, errors.New("the peer sent no blocks")
+	}
+	return blocks, nil
 }
 
 // requestPeers sends a request for the peers to every peer the node knows
@@ -222,8 +471,9 @@ func (n *NodeServer) requestPool() {
 		if err != nil {
 			continue
 		}
+		sort.SliceStable(trans, func(i, j int) bool { return trans[i].nonce < trans[j].nonce })
 		for _, t := range trans {
-			if !n.node.transactionPool.DoesExists(t) {
+			if !n.node.transactionPool.DoesExists(t) && n.node.verifyTransaction(t) == nil {
 				n.node.transactionPool.addTransaction(t)
 				fmt.Printf("Added a new transaction from %s\n", peer)
 			}
@@ -25,10 +25,31 @@ const (
 	PA = "Peer-Addresses"
 	// BP is Blocks-Packet
 	BP = "Blocks-Packet"
+	// HR is Headers-Request
+	HR = "Headers-Request"
+	// HP is Headers-Packet
+	HP = "Headers-Packet"
+	// BRR is Blocks-Range-Request
+	BRR = "Blocks-Range-Request"
+)
+
+const (
+
+	// MaxHeadersPerPacket is the maximum number of headers sent in a single HP
+	MaxHeadersPerPacket = 200
+
+	// MaxForkSearch is the maximum number of headers of a peer searched back from the top of the
+	// blockchain for the latest block they share
+	MaxForkSearch = 10 * MaxHeadersPerPacket
+
+	// MaxBlocksPerPacket is the maximum number of blocks sent in a single BP
+	MaxBlocksPerPacket = 10
 )
 
 // Packet is the struct for transferring data between Nodes
 type Packet struct {
+	magic       uint32
+	port        int
 	requestType string
 	data        []byte
 }
@@ -36,6 +57,8 @@ type Packet struct {
 var (
 	// ErrPacketType is an error for a packet with the wrong message type
 	ErrPacketType = errors.New("Invalid Packet Type")
+	// ErrNetworkMagic is an error for a packet of another network
+	ErrNetworkMagic = errors.New("Packet of another network")
 )
 
 // NewPacket returns a new packet
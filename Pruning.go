@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+)
+
+const (
+
+	// MinPruneDepth is the least number of the latest blocks a pruned blockchain keeps the bodies of,
+	// so it can still switch to a branch that forks below its top
+	MinPruneDepth = 288
+)
+
+// checkPruneDepth checks the number of block bodies a pruned blockchain keeps. Zero keeps them all
+func checkPruneDepth(depth int) error {
+	if depth != 0 && depth < MinPruneDepth {
+		return fmt.Errorf("a pruned blockchain keeps at least the last %d blocks, not %d", MinPruneDepth, depth)
+	}
+	return nil
+}
+
+// prune drops the bodies of the blocks below the latest prune depth blocks, if the blockchain is
+// pruned. The account state must be saved at the top block first, since the blockchain can't be
+// loaded from the bodies it has left otherwise. The caller must hold the blockchain's mutex
+func (bc *Blockchain) prune() error {
+	if bc.pruneDepth == 0 || len(bc.headers) <= bc.pruneDepth {
+		return nil
+	}
+	return bc.store.Prune(len(bc.headers) - bc.pruneDepth)
+}
+
+// Pruned returns the index of the lowest block whose body the blockchain keeps. The bodies of the
+// blocks below it were pruned, and only their headers are kept
+func (bc *Blockchain) Pruned() int {
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+	return bc.store.Pruned()
+}
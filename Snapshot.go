@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+)
+
+const (
+	// SnapshotMagic starts every snapshot file
+	SnapshotMagic = "IBSNAP"
+	// SnapshotVersion is the version of the snapshot format this node writes and reads
+	SnapshotVersion uint16 = 1
+	// VerifyFull validates every block of an imported snapshot as if it was received from a peer
+	VerifyFull = "full"
+	// VerifyHeaders validates the headers, Merkle roots and coinbases of an imported snapshot, and
+	// trusts the transactions to match the account state it carries
+	VerifyHeaders = "headers"
+)
+
+const (
+	// snapshotMeta is the record that describes the snapshot
+	snapshotMeta = 'M'
+	// snapshotBlock is the record of a single block
+	snapshotBlock = 'B'
+	// snapshotState is the record of the account state at the top block
+	snapshotState = 'S'
+)
+
+var (
+	// ErrSnapshotChecksum is an error for a snapshot file that doesn't match its checksum
+	ErrSnapshotChecksum = errors.New("the snapshot doesn't match its checksum")
+	// ErrChainNotEmpty is an error for importing a snapshot into a blockchain that has blocks
+	ErrChainNotEmpty = errors.New("a snapshot can only be imported into an empty data directory")
+	// ErrExportPruned is an error for exporting a pruned blockchain, which lacks the blocks a snapshot holds
+	ErrExportPruned = errors.New("a pruned blockchain can't be exported, since a snapshot holds every block")
+)
+
+// A snapshot file is the magic and the version followed by records, in the format of the records
+// of a LogStore: the meta record, a block record for every block from the origin up, and the
+// state record. The SHA-256 of everything before it ends the file
+
+// Export writes the blockchain and its account state to a snapshot file. A pruned blockchain can't be
+// exported
+func (bc *Blockchain) Export(file string) (*JSONSnapshotMeta, error) {
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+	if bc.store.Pruned() > 0 {
+		return nil, ErrExportPruned
+	}
+	f, err := ioutil.TempFile(path.Dir(file), path.Base(file)+".tmp")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	sum := sha256.New()
+	w := bufio.NewWriter(io.MultiWriter(f, sum))
+	head := make([]byte, len(SnapshotMagic)+2)
+	copy(head, SnapshotMagic)
+	binary.BigEndian.PutUint16(head[len(SnapshotMagic):], SnapshotVersion)
+	if _, err := w.Write(head); err != nil {
+		return nil, err
+	}
+	top := bc.headers[len(bc.headers)-1]
+	meta := &JSONSnapshotMeta{
+		Network: bc.network.name,
+		Genesis: bc.network.genesis.hash,
+		Height:  top.index,
+		Tip:     top.hash,
+		Created: GetCurrentMillis(),
+	}
+	if err := writeSnapshotRecord(w, snapshotMeta, meta); err != nil {
+		return nil, err
+	}
+	err = bc.store.Iterate(0, func(b *Block) error {
+		return writeSnapshotRecord(w, snapshotBlock, b)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := writeSnapshotRecord(w, snapshotState, bc.state); err != nil {
+		return nil, err
+	}
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+	if _, err := f.Write(sum.Sum(nil)); err != nil {
+		return nil, err
+	}
+	if err := f.Sync(); err != nil {
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(f.Name(), file); err != nil {
+		return nil, err
+	}
+	return meta, syncDir(path.Dir(file))
+}
+
+// writeSnapshotRecord writes a record of the received kind with v encoded as its payload
+func writeSnapshotRecord(w io.Writer, kind byte, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(encodeLogRecord(append([]byte{kind}, data...)))
+	return err
+}
+
+// Import fills an empty blockchain with the blocks of a snapshot file, validated by the received
+// verification mode. The account state they build must match the one of the snapshot. Nothing is
+// kept unless the whole snapshot is imported
+func (bc *Blockchain) Import(file, verify string) (*JSONSnapshotMeta, error) {
+	if verify != VerifyFull && verify != VerifyHeaders {
+		return nil, fmt.Errorf("unknown verification mode %q", verify)
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	size, err := checkSnapshotSum(f)
+	if err != nil {
+		return nil, err
+	}
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+	if len(bc.headers) != 1 {
+		return nil, ErrChainNotEmpty
+	}
+	meta, err := bc.importSnapshot(bufio.NewReader(io.LimitReader(f, size)), verify)
+	if err != nil {
+		batch := bc.store.Batch()
+		batch.Truncate(1)
+		if cerr := batch.Commit(); cerr != nil {
+			return nil, fmt.Errorf("%s, and failed to remove the imported blocks: %s", err, cerr)
+		}
+		return nil, err
+	}
+	return meta, nil
+}
+
+// checkSnapshotSum checks the checksum of a snapshot file and returns the size of the part it
+// covers. The file is left at its start
+func checkSnapshotSum(f *os.File) (int64, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	size := info.Size() - sha256.Size
+	if size < int64(len(SnapshotMagic)+2) {
+		return 0, errors.New("the file is too short to be a snapshot")
+	}
+	sum := sha256.New()
+	if _, err := io.Copy(sum, io.LimitReader(f, size)); err != nil {
+		return 0, err
+	}
+	expected := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(f, expected); err != nil {
+		return 0, err
+	}
+	if !bytes.Equal(sum.Sum(nil), expected) {
+		return 0, ErrSnapshotChecksum
+	}
+	_, err = f.Seek(0, io.SeekStart)
+	return size, err
+}
+
+// importSnapshot reads the records of a snapshot and connects its blocks, a chunk at a time
+func (bc *Blockchain) importSnapshot(r io.Reader, verify string) (*JSONSnapshotMeta, error) {
+	head := make([]byte, len(SnapshotMagic)+2)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, err
+	}
+	if string(head[:len(SnapshotMagic)]) != SnapshotMagic {
+		return nil, errors.New("the file is not a snapshot")
+	}
+	if version := binary.BigEndian.Uint16(head[len(SnapshotMagic):]); version != SnapshotVersion {
+		return nil, fmt.Errorf("snapshot version %d is not supported, only %d", version, SnapshotVersion)
+	}
+	kind, payload, err := readSnapshotRecord(r)
+	if err != nil {
+		return nil, err
+	}
+	if kind != snapshotMeta {
+		return nil, errors.New("the snapshot doesn't start with its meta record")
+	}
+	var meta JSONSnapshotMeta
+	if err := json.Unmarshal(payload, &meta); err != nil {
+		return nil, err
+	}
+	if meta.Genesis != bc.network.genesis.hash {
+		return nil, fmt.Errorf("the snapshot is of the %s network, with origin block %s", meta.Network, meta.Genesis)
+	}
+	chunk := make([]*Block, 0, LoadChunkSize)
+	for {
+		kind, payload, err = readSnapshotRecord(r)
+		if err != nil {
+			return nil, err
+		}
+		if kind != snapshotBlock {
+			break
+		}
+		b, err := ToBlock(payload)
+		if err != nil {
+			return nil, err
+		}
+		if b.index == 0 {
+			if b.hash != bc.network.genesis.hash {
+				return nil, errors.New("the snapshot starts with another origin block")
+			}
+			continue
+		}
+		chunk = append(chunk, b)
+		if len(chunk) == LoadChunkSize {
+			if err := bc.importChunk(chunk, verify); err != nil {
+				return nil, err
+			}
+			chunk = chunk[:0]
+		}
+	}
+	if err := bc.importChunk(chunk, verify); err != nil {
+		return nil, err
+	}
+	if kind != snapshotState {
+		return nil, fmt.Errorf("unexpected snapshot record %q", kind)
+	}
+	var state AccountState
+	if err := json.Unmarshal(payload, &state); err != nil {
+		return nil, err
+	}
+	if _, _, err := readSnapshotRecord(r); err != io.EOF {
+		return nil, errors.New("the snapshot has records after its account state")
+	}
+	top := bc.headers[len(bc.headers)-1]
+	if top.index != meta.Height || top.hash != meta.Tip {
+		return nil, fmt.Errorf("the snapshot ends at block %d (%s) instead of %d (%s)", top.index, top.hash, meta.Height, meta.Tip)
+	}
+	if err := bc.state.equals(&state); err != nil {
+		return nil, fmt.Errorf("the account state of the snapshot doesn't match its blocks: %s", err)
+	}
+	return &meta, nil
+}
+
+// readSnapshotRecord reads a single record of a snapshot and returns its kind and payload
+func readSnapshotRecord(r io.Reader) (byte, []byte, error) {
+	payload, err := readLogRecord(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	return payload[0], payload[1:], nil
+}
+
+// importChunk validates consecutive blocks on top of the blockchain, stores and connects them
+func (bc *Blockchain) importChunk(chunk []*Block, verify string) error {
+	if len(chunk) == 0 {
+		return nil
+	}
+	var err error
+	if verify == VerifyFull {
+		_, err = bc.validateBlocks(len(bc.headers), bc.state.copy(), chunk, -1)
+	} else {
+		_, err = bc.validateStructures(len(bc.headers), chunk)
+	}
+	if err != nil {
+		return err
+	}
+	batch := bc.store.Batch()
+	for _, b := range chunk {
+		batch.Put(b)
+	}
+	if err := batch.Commit(); err != nil {
+		return err
+	}
+	for _, b := range chunk {
+		bc.connectBlock(b)
+	}
+	return nil
+}
+
+// openBlockchain reads the config of a data directory and opens the blockchain of its network, for
+// the commands that work on the data directory of a node that isn't running. It locks the data
+// directory until the returned lock file is closed
+func openBlockchain(dataDir string) (*Blockchain, *os.File, error) {
+	config, err := readJSON(dataDir)
+	if err != nil {
+		return nil, nil, err
+	}
+	network, err := loadNetwork(config.DataDir, config.Network)
+	if err != nil {
+		return nil, nil, err
+	}
+	lock, err := lockDataDir(config.DataDir)
+	if err != nil {
+		return nil, nil, err
+	}
+	var bc Blockchain
+	bc.init(network, config)
+	return &bc, lock, nil
+}
+
+// runExport writes the blockchain of the configured network to a snapshot file. The node must not be
+// running
+func runExport(args []string) error {
+	flags := flag.NewFlagSet("chain export", flag.ContinueOnError)
+	dataDir := flags.String("datadir", DefaultDataDir, "data directory of the node")
+	out := flags.String("out", "", "snapshot file to write")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *out == "" {
+		return errors.New("a snapshot file is required")
+	}
+	bc, lock, err := openBlockchain(*dataDir)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	defer bc.store.Close()
+	meta, err := bc.Export(*out)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Exported %s blocks 0 to %d (%s) to %s\n", meta.Network, meta.Height, meta.Tip, *out)
+	return nil
+}
+
+// runImport fills the empty data directory of the configured network from a snapshot file. The node
+// must not be running
+func runImport(args []string) error {
+	flags := flag.NewFlagSet("chain import", flag.ContinueOnError)
+	dataDir := flags.String("datadir", DefaultDataDir, "data directory of the node")
+	in := flags.String("in", "", "snapshot file to read")
+	verify := flags.String("verify", VerifyFull, "verification of the blocks, full or headers")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *in == "" {
+		return errors.New("a snapshot file is required")
+	}
+	bc, lock, err := openBlockchain(*dataDir)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	defer bc.store.Close()
+	meta, err := bc.Import(*in, *verify)
+	if err != nil {
+		return err
+	}
+	if err := bc.saveBlockchain(); err != nil {
+		return err
+	}
+	fmt.Printf("Imported %s blocks 0 to %d (%s) from %s\n", meta.Network, meta.Height, meta.Tip, *in)
+	return nil
+}
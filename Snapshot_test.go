@@ -0,0 +1,93 @@
+package main
+
+import (
+	"path"
+	"testing"
+
+	ec "github.com/IBentu/CryptoCurrency/EClib"
+)
+
+// newTestNode returns a node with new keys and an empty regtest blockchain in a new data directory
+func newTestNode(t *testing.T) *Node {
+	network, err := builtinNetwork(Regtest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := &Node{blockchain: &Blockchain{}, transactionPool: &TransactionPool{}}
+	n.blockchain.init(network, &JSONConfig{Store: StoreLog, DataDir: t.TempDir()})
+	n.transactionPool.init()
+	n.privKey, n.pubKey = ec.ECGenerateKey()
+	t.Cleanup(func() { n.blockchain.Close() })
+	return n
+}
+
+// mineBlocks mines count blocks on top of the blockchain of a node
+func mineBlocks(t *testing.T, n *Node, count int) {
+	for i := 0; i < count; i++ {
+		if !n.mine() {
+			t.Fatal("could not mine a block")
+		}
+	}
+}
+
+// switchTo switches the blockchain of a node to the blockchain of another node from index fork
+func switchTo(t *testing.T, n, other *Node, fork int) {
+	headers := other.blockchain.GetHeaders(fork, other.blockchain.Length())
+	_, err := n.blockchain.SwitchBranch(headers, func(index, count int) ([]*Block, error) {
+		return other.blockchain.GetBlocks(index, 2), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.blockchain.GetLatestHash() != other.blockchain.GetLatestHash() {
+		t.Fatal("the blockchain didn't switch to the other blockchain")
+	}
+}
+
+func TestSnapshotRoundTripAfterReorg(t *testing.T) {
+	a := newTestNode(t)
+	mineBlocks(t, a, 2)
+	// x receives coins and spends all of them, so its balance is zero below the fork
+	x := newTestNode(t)
+	x.blockchain, x.transactionPool = a.blockchain, a.transactionPool
+	if !a.makeTransaction(x.pubKey, 5, 1) {
+		t.Fatal("could not send to x")
+	}
+	mineBlocks(t, a, 1)
+	if !x.makeTransaction(a.pubKey, 4, 1) {
+		t.Fatal("could not send from x")
+	}
+	mineBlocks(t, a, 1)
+	fork := a.blockchain.Length()
+
+	b := newTestNode(t)
+	switchTo(t, b, a, 0)
+	mineBlocks(t, b, 3)
+	// the replaced block touches x again, so disconnecting it removes x from the account state
+	if !a.makeTransaction(x.pubKey, 1, 1) {
+		t.Fatal("could not send to x")
+	}
+	mineBlocks(t, a, 1)
+	switchTo(t, a, b, fork-1)
+	if err := a.blockchain.CheckState(); err != nil {
+		t.Fatal(err)
+	}
+
+	file := path.Join(t.TempDir(), "chain.snap")
+	if _, err := a.blockchain.Export(file); err != nil {
+		t.Fatal(err)
+	}
+	c := newTestNode(t)
+	meta, err := c.blockchain.Import(file, VerifyFull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Tip != b.blockchain.GetLatestHash() || c.blockchain.GetLatestHash() != meta.Tip {
+		t.Fatal("the imported blockchain doesn't end at the exported top block")
+	}
+	for _, key := range []string{a.pubKey, b.pubKey, x.pubKey} {
+		if c.blockchain.GetBalance(key) != a.blockchain.GetBalance(key) || c.blockchain.GetNonce(key) != a.blockchain.GetNonce(key) {
+			t.Fatalf("the imported account of %s doesn't match the exported one", key)
+		}
+	}
+}
@@ -1,29 +1,56 @@
 package main
 
-import "fmt"
+import (
+	ec "github.com/IBentu/CryptoCurrency/EClib"
+)
 
 // Transaction is a single transaction and is saved on the blockchain in it
 type Transaction struct {
 	senderKey    string
 	recipientKey string
 	amount       int
+	fee          int
+	nonce        int
 	timestamp    int64
 	hash         string
 	sign         string
 }
 
-// toString returns all the Transaction's fields that need to be hashed as a formatted
-func (t *Transaction) toHashString() string {
-	return fmt.Sprintf("%s%s%d%d", t.senderKey, t.recipientKey, t.amount, t.timestamp)
+// computeHash returns the hash of the canonical encoding of the Transaction's signed fields
+func (t *Transaction) computeHash() string {
+	return ec.ECHashTransaction(t.senderKey, t.recipientKey, t.amount, t.fee, t.nonce, t.timestamp)
 }
 
-//transactionSliceToByteSlice returns a string that can be hashed
-func transactionSliceToHashString(transactions []*Transaction) string {
-	str := ""
-	for i := 0; i < len(transactions); i++ {
-		str += transactions[i].toHashString()
+// newCoinbase creates the coinbase transaction of a block, which credits the block reward to its
+// miner. A coinbase has no sender and no signature, and its nonce is the index of its block
+func newCoinbase(miner string, amount, index int, timestamp int64) *Transaction {
+	t := &Transaction{
+		recipientKey: miner,
+		amount:       amount,
+		nonce:        index,
+		timestamp:    timestamp,
 	}
-	return str
+	t.hash = t.computeHash()
+	return t
+}
+
+// isCoinbase checks if the Transaction is a coinbase
+func (t *Transaction) isCoinbase() bool {
+	return t.senderKey == ""
+}
+
+// verifySignature checks that the Transaction's hash matches its fields and that it was signed by the sender
+func (t *Transaction) verifySignature() bool {
+	return t.hash == t.computeHash() && ec.ECVerify(t.hash, t.sign, t.senderKey)
+}
+
+// size returns the number of bytes the Transaction takes in a block
+func (t *Transaction) size() int {
+	data, err := t.Format()
+	if err != nil {
+		return 0
+	}
+	return len(data)
 }
 
 // Format formats a Transaction to a []byte
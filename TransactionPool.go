@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"sort"
 	"sync"
 )
 
@@ -36,6 +37,45 @@ func (tp *TransactionPool) remove() *Transaction {
 	return t
 }
 
+// pendingFrom returns the nonce and the spending of a sender after its pending transactions, starting
+// from the received nonce. Only transactions that continue the nonce sequence are counted
+func (tp *TransactionPool) pendingFrom(sender string, nonce int) (int, int) {
+	tp.mutex.Lock()
+	trans := make([]*Transaction, 0)
+	for _, t := range tp.transactions {
+		if t.senderKey == sender {
+			trans = append(trans, t)
+		}
+	}
+	tp.mutex.Unlock()
+	sort.Slice(trans, func(i, j int) bool { return trans[i].nonce < trans[j].nonce })
+	spent := 0
+	for _, t := range trans {
+		if t.nonce == nonce {
+			nonce++
+			spent += t.amount + t.fee
+		}
+	}
+	return nonce, spent
+}
+
+// byFeeRate returns the pending transactions ordered by their fee per byte, highest first
+func (tp *TransactionPool) byFeeRate() []*Transaction {
+	tp.mutex.Lock()
+	trans := make([]*Transaction, len(tp.transactions))
+	copy(trans, tp.transactions)
+	tp.mutex.Unlock()
+	sizes := make(map[*Transaction]int)
+	for _, t := range trans {
+		sizes[t] = t.size()
+	}
+	sort.SliceStable(trans, func(i, j int) bool {
+		// compares fee_i/size_i > fee_j/size_j without dividing
+		return trans[i].fee*sizes[trans[j]] > trans[j].fee*sizes[trans[i]]
+	})
+	return trans
+}
+
 // addTransaction add a transactin to the pending transaction slice
 func (tp *TransactionPool) addTransaction(t *Transaction) {
 	tp.mutex.Lock()
@@ -50,6 +90,36 @@ func (tp *TransactionPool) addTransactions(trans []*Transaction) {
 	}
 }
 
+// removeTransactions removes the received transactions from the pending transaction slice
+func (tp *TransactionPool) removeTransactions(trans []*Transaction) {
+	hashes := make(map[string]bool)
+	for _, t := range trans {
+		hashes[t.hash] = true
+	}
+	tp.mutex.Lock()
+	remaining := make([]*Transaction, 0, len(tp.transactions))
+	for _, t := range tp.transactions {
+		if !hashes[t.hash] {
+			remaining = append(remaining, t)
+		}
+	}
+	tp.transactions = remaining
+	tp.mutex.Unlock()
+}
+
+// removeConfirmed removes the transactions whose hashes are confirmed from the pending transaction slice
+func (tp *TransactionPool) removeConfirmed(confirmed func(string) bool) {
+	tp.mutex.Lock()
+	remaining := make([]*Transaction, 0, len(tp.transactions))
+	for _, t := range tp.transactions {
+		if !confirmed(t.hash) {
+			remaining = append(remaining, t)
+		}
+	}
+	tp.transactions = remaining
+	tp.mutex.Unlock()
+}
+
 //FormatSTPM fomrmats a slice of Transactions to []byte
 func (tp *TransactionPool) FormatSTPM() []byte {
 	var data []byte
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"path"
+)
+
+// TxLocation is the place of a confirmed transaction in the blockchain
+type TxLocation struct {
+	BlockIndex int `json:"blockIndex"`
+	Position   int `json:"position"`
+}
+
+// TxIndex maps the hashes of the confirmed transactions to their place in the blockchain. It is
+// guarded by the mutex of the Blockchain it belongs to
+type TxIndex struct {
+	Tip       string                `json:"tip"`
+	Locations map[string]TxLocation `json:"locations"`
+}
+
+var (
+	// ErrTransactionNotFound is an error for a transaction that isn't in the blockchain
+	ErrTransactionNotFound = errors.New("transaction not found")
+)
+
+// newTxIndex returns an empty TxIndex
+func newTxIndex() *TxIndex {
+	return &TxIndex{Locations: make(map[string]TxLocation)}
+}
+
+// buildTxIndex builds a TxIndex from the blocks of a store, from the lowest block whose body it
+// keeps up
+func buildTxIndex(store BlockStore) (*TxIndex, error) {
+	idx := newTxIndex()
+	err := store.Iterate(store.Pruned(), func(b *Block) error {
+		idx.connectBlock(b)
+		return nil
+	})
+	return idx, err
+}
+
+// connectBlock adds the transactions of a block to the index
+func (idx *TxIndex) connectBlock(b *Block) {
+	for i, t := range b.transactions {
+		idx.Locations[t.hash] = TxLocation{BlockIndex: b.index, Position: i}
+	}
+	idx.Tip = b.hash
+}
+
+// disconnectBlock removes the transactions of a block from the index
+func (idx *TxIndex) disconnectBlock(b *Block) {
+	for _, t := range b.transactions {
+		delete(idx.Locations, t.hash)
+	}
+	idx.Tip = b.prevHash
+}
+
+// txIndexPath returns the path of the tx index file in a data directory
+func txIndexPath(dataDir string) string {
+	return path.Join(dataDir, "txindex.json")
+}
+
+// readTxIndex reads the tx index from txindex.json in a data directory
+func readTxIndex(dataDir string) (*TxIndex, error) {
+	data, err := ioutil.ReadFile(txIndexPath(dataDir))
+	if err != nil {
+		return nil, err
+	}
+	idx := newTxIndex()
+	if err := json.Unmarshal(data, idx); err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+// save writes the tx index to txindex.json in a data directory
+func (idx *TxIndex) save(dataDir string) error {
+	data, err := json.Marshal(idx)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(txIndexPath(dataDir), data)
+}
+
+// GetTransaction returns a confirmed transaction by its hash, its location and the number of
+// confirmations it has
+func (bc *Blockchain) GetTransaction(hash string) (*Transaction, TxLocation, int, error) {
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+	loc, ok := bc.txIndex.Locations[hash]
+	if !ok {
+		return nil, TxLocation{}, 0, ErrTransactionNotFound
+	}
+	b, err := bc.store.Get(loc.BlockIndex)
+	if err != nil {
+		return nil, TxLocation{}, 0, err
+	}
+	return b.transactions[loc.Position], loc, len(bc.headers) - loc.BlockIndex, nil
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"fmt"
+)
+
+const (
+	// RuleGenesis is broken by a chain that doesn't start with our origin block
+	RuleGenesis = "genesis"
+	// RuleIndex is broken by a block that doesn't follow the index of the block before it
+	RuleIndex = "index"
+	// RulePrevHash is broken by a block that doesn't point to the hash of the block before it
+	RulePrevHash = "prevHash"
+	// RuleMerkleRoot is broken by a block whose Merkle root doesn't match its transactions
+	RuleMerkleRoot = "merkleRoot"
+	// RuleHash is broken by a block whose hash doesn't match its fields
+	RuleHash = "hash"
+	// RuleDifficulty is broken by a block that claims a difficulty other than the retarget rule's
+	RuleDifficulty = "difficulty"
+	// RulePOW is broken by a block whose hash doesn't satisfy the Proof-of-Work
+	RulePOW = "proof-of-work"
+	// RuleMedianTime is broken by a block with a timestamp not after the median of the blocks before it
+	RuleMedianTime = "median-time-past"
+	// RuleFutureTime is broken by a block with a timestamp too far ahead of the local clock
+	RuleFutureTime = "future-time"
+	// RuleBlockSize is broken by a block that takes more bytes than the network allows
+	RuleBlockSize = "block-size"
+	// RuleTransactionCount is broken by a block that holds more transactions than the network allows
+	RuleTransactionCount = "transaction-count"
+	// RuleCheckpoint is broken by a block at a checkpoint height with another hash, or by a branch
+	// that forks below a checkpoint
+	RuleCheckpoint = "checkpoint"
+	// RuleTransactionTime is broken by a block that holds a transaction with an insane timestamp
+	RuleTransactionTime = "transaction-time"
+	// RuleCoinbase is broken by a block that doesn't start with a single valid coinbase
+	RuleCoinbase = "coinbase"
+	// RuleTransaction is broken by a block that holds an invalid transaction
+	RuleTransaction = "transaction"
+)
+
+// ValidationError describes the block and the rule that made a chain invalid
+type ValidationError struct {
+	Index  int
+	Hash   string
+	Rule   string
+	Reason string
+}
+
+// Error is an implementation of error
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("block %d (%s) broke the %s rule: %s", e.Index, e.Hash, e.Rule, e.Reason)
+}
+
+// newValidationError returns a ValidationError for the block with the received index and hash
+func newValidationError(index int, hash string, rule, reason string, args ...interface{}) *ValidationError {
+	return &ValidationError{
+		Index:  index,
+		Hash:   hash,
+		Rule:   rule,
+		Reason: fmt.Sprintf(reason, args...),
+	}
+}
+
+// ValidateChain validates every block of the blockchain from the origin block. Of a pruned
+// blockchain, only the headers of the pruned blocks and the structure of the kept blocks are
+// validated, since their transactions can't be replayed
+func (bc *Blockchain) ValidateChain() error {
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+	if pruned := bc.store.Pruned(); pruned > 0 {
+		now := GetCurrentMillis()
+		for i := 1; i < pruned; i++ {
+			if err := bc.validateHeader(bc.headers[i], bc.headers[:i], now); err != nil {
+				return err
+			}
+		}
+		return iterateChunks(bc.store, pruned, LoadChunkSize, func(chunk []*Block) error {
+			_, err := bc.validateStructures(chunk[0].index, chunk)
+			return err
+		})
+	}
+	state := bc.genesisState()
+	assumed := bc.assumedValid(bc.headers, nil)
+	return iterateChunks(bc.store, 1, LoadChunkSize, func(chunk []*Block) error {
+		_, err := bc.validateBlocks(chunk[0].index, state, chunk, assumed)
+		return err
+	})
+}
+
+// ValidateHeaders validates headers that extend chain, a chain of headers from the origin block
+// that forks from the blockchain. The first call gets the headers of the blockchain up to the fork
+// and every later call the chain the call before it returned, so a long branch is validated a chunk
+// at a time. It returns chain with the headers appended
+func (bc *Blockchain) ValidateHeaders(chain, headers []*BlockHeader) ([]*BlockHeader, error) {
+	if len(headers) == 0 {
+		return chain, nil
+	}
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+	if len(chain) == 0 || chain[0].hash != bc.headers[0].hash {
+		return chain, newValidationError(headers[0].index, headers[0].hash, RuleGenesis, "the headers don't start at a block of ours")
+	}
+	// headers that leave the blockchain replace our blocks, so they may not fork below a checkpoint we have
+	index := len(chain) - 1
+	if index < len(bc.headers) && bc.headers[index].hash == chain[index].hash {
+		if cp := bc.checkpoints.last(len(bc.headers) - 1); index < cp && bc.headers[index+1].hash != headers[0].hash {
+			return chain, newValidationError(index+1, headers[0].hash, RuleCheckpoint, "the headers fork below the checkpoint at height %d", cp)
+		}
+	}
+	now := GetCurrentMillis()
+	for _, h := range headers {
+		if err := bc.validateHeader(h, chain, now); err != nil {
+			return chain, err
+		}
+		chain = append(chain, h)
+	}
+	return chain, nil
+}
+
+// validateGenesis validates an origin block on its own: its hash, its Proof-of-Work and its
+// allocations, which must be coinbases with nonce 0
+func validateGenesis(b *Block) error {
+	if b.index != 0 {
+		return newValidationError(b.index, b.hash, RuleGenesis, "the origin block must have index 0")
+	}
+	if b.nuance == nil {
+		return newValidationError(b.index, b.hash, RuleHash, "missing nuance")
+	}
+	if b.nuance.Sign() < 0 {
+		return newValidationError(b.index, b.hash, RuleHash, "negative nuance")
+	}
+	if root := computeMerkleRoot(b.transactions); b.merkleRoot != root {
+		return newValidationError(b.index, b.hash, RuleMerkleRoot, "recomputed Merkle root is %s", root)
+	}
+	if recomputed := b.Header().computeHash(); b.hash != recomputed {
+		return newValidationError(b.index, b.hash, RuleHash, "recomputed hash is %s", recomputed)
+	}
+	if !b.verifyPOW() {
+		return newValidationError(b.index, b.hash, RulePOW, "less than %d leading zero bits", b.difficulty)
+	}
+	for i, t := range b.transactions {
+		if !t.isCoinbase() || t.nonce != 0 || t.amount <= 0 || t.hash != t.computeHash() {
+			return newValidationError(b.index, b.hash, RuleCoinbase, "transaction %d isn't a valid allocation", i)
+		}
+	}
+	return nil
+}
+
+// validateBlocks validates each block of segment on top of the first length blocks of the
+// blockchain, whose account state is received and is advanced by the valid blocks. The signatures
+// of the transactions of the blocks up to index assumed, the assume-valid block and its ancestors,
+// are trusted, but the transactions must still match their hashes, which the block hashes cover
+// through the Merkle roots. It returns the number of valid blocks at the start of segment. The
+// caller must hold the blockchain's mutex
+func (bc *Blockchain) validateBlocks(length int, state *AccountState, segment []*Block, assumed int) (int, error) {
+	seen := make(map[string]bool)
+	confirmed := func(hash string) bool {
+		loc, ok := bc.txIndex.Locations[hash]
+		return seen[hash] || (ok && loc.BlockIndex < length)
+	}
+	chain := make([]*BlockHeader, length, length+len(segment))
+	copy(chain, bc.headers[:length])
+	now := GetCurrentMillis()
+	for valid, b := range segment {
+		h := b.Header()
+		if err := bc.validateStructure(b, chain, now); err != nil {
+			return valid, err
+		}
+		// the transactions are applied one by one, so every sender must afford all its transactions
+		// in the block and use its nonces in order
+		for i, t := range b.transactions[1:] {
+			if err := bc.consensus.checkTransactionTime(t, b.timestamp); err != nil {
+				return valid, newValidationError(b.index, b.hash, RuleTransactionTime, "transaction %d (%s): %s", i+1, t.hash, err)
+			}
+			if err := validateTransaction(t, state, confirmed, b.index > assumed); err != nil {
+				return valid, newValidationError(b.index, b.hash, RuleTransaction, "transaction %d (%s): %s", i+1, t.hash, err)
+			}
+			state.connectTransaction(t)
+			seen[t.hash] = true
+		}
+		coinbase := b.transactions[0]
+		if confirmed(coinbase.hash) {
+			return valid, newValidationError(b.index, b.hash, RuleCoinbase, "coinbase already exists")
+		}
+		state.connectTransaction(coinbase)
+		seen[coinbase.hash] = true
+		chain = append(chain, h)
+	}
+	return len(segment), nil
+}
+
+// assumedValid returns the index of the assume-valid block in a chain of headers from the origin
+// block, made of chain and the branch that continues it, or -1 if the chain doesn't have it
+func (bc *Blockchain) assumedValid(chain, branch []*BlockHeader) int {
+	if bc.assumeValid == "" {
+		return -1
+	}
+	for _, headers := range [][]*BlockHeader{chain, branch} {
+		for _, h := range headers {
+			if h.hash == bc.assumeValid {
+				return h.index
+			}
+		}
+	}
+	return -1
+}
+
+// validateStructure checks everything about a block that doesn't depend on the account state: its
+// header on top of chain, its limits, its Merkle root and its coinbase
+func (bc *Blockchain) validateStructure(b *Block, chain []*BlockHeader, now int64) error {
+	if err := bc.validateHeader(b.Header(), chain, now); err != nil {
+		return err
+	}
+	if err := bc.consensus.checkBlockLimits(b); err != nil {
+		return err
+	}
+	if root := computeMerkleRoot(b.transactions); b.merkleRoot != root {
+		return newValidationError(b.index, b.hash, RuleMerkleRoot, "recomputed Merkle root is %s", root)
+	}
+	return validateCoinbase(b, bc.policy.subsidy(b.index))
+}
+
+// validateStructures validates the structure of consecutive blocks on top of the first length
+// blocks of the chain. It returns the number of valid blocks at the start of the segment
+func (bc *Blockchain) validateStructures(length int, segment []*Block) (int, error) {
+	chain := make([]*BlockHeader, length, length+len(segment))
+	copy(chain, bc.headers[:length])
+	now := GetCurrentMillis()
+	for valid, b := range segment {
+		if err := bc.validateStructure(b, chain, now); err != nil {
+			return valid, err
+		}
+		chain = append(chain, b.Header())
+	}
+	return len(segment), nil
+}
+
+// validateHeader validates the header rules of a block on top of chain, which must start at the
+// origin block
+func (bc *Blockchain) validateHeader(h *BlockHeader, chain []*BlockHeader, now int64) error {
+	prev := chain[len(chain)-1]
+	if h.index != prev.index+1 {
+		return newValidationError(h.index, h.hash, RuleIndex, "expected index %d", prev.index+1)
+	}
+	if h.prevHash != prev.hash {
+		return newValidationError(h.index, h.hash, RulePrevHash, "expected previous hash %s", prev.hash)
+	}
+	if h.nuance == nil {
+		return newValidationError(h.index, h.hash, RuleHash, "missing nuance")
+	}
+	if h.nuance.Sign() < 0 {
+		return newValidationError(h.index, h.hash, RuleHash, "negative nuance")
+	}
+	if recomputed := h.computeHash(); h.hash != recomputed {
+		return newValidationError(h.index, h.hash, RuleHash, "recomputed hash is %s", recomputed)
+	}
+	if expected := bc.retarget.nextDifficulty(chain); h.difficulty != expected {
+		return newValidationError(h.index, h.hash, RuleDifficulty, "expected difficulty %d, got %d", expected, h.difficulty)
+	}
+	if !h.verifyPOW() {
+		return newValidationError(h.index, h.hash, RulePOW, "less than %d leading zero bits", h.difficulty)
+	}
+	if !bc.checkpoints.matches(h) {
+		return newValidationError(h.index, h.hash, RuleCheckpoint, "expected the checkpoint %s", bc.checkpoints.hashes[h.index])
+	}
+	if mtp := bc.consensus.medianTimePast(chain); h.timestamp <= mtp {
+		return newValidationError(h.index, h.hash, RuleMedianTime, "timestamp %d isn't after the median time %d", h.timestamp, mtp)
+	}
+	if h.timestamp > now+bc.consensus.maxFutureDrift {
+		return newValidationError(h.index, h.hash, RuleFutureTime, "timestamp %d is too far in the future", h.timestamp)
+	}
+	return nil
+}
+
+// validateCoinbase checks that the first transaction of a block, and only it, is a coinbase that
+// credits the block reward and the fees of the block to the miner
+func validateCoinbase(b *Block, subsidy int) error {
+	if len(b.transactions) == 0 || !b.transactions[0].isCoinbase() {
+		return newValidationError(b.index, b.hash, RuleCoinbase, "the first transaction isn't a coinbase")
+	}
+	coinbase := b.transactions[0]
+	if coinbase.hash != coinbase.computeHash() {
+		return newValidationError(b.index, b.hash, RuleCoinbase, "invalid coinbase hash")
+	}
+	if coinbase.nonce != b.index {
+		return newValidationError(b.index, b.hash, RuleCoinbase, "the coinbase nonce isn't the block index")
+	}
+	if coinbase.recipientKey != b.miner {
+		return newValidationError(b.index, b.hash, RuleCoinbase, "the coinbase doesn't credit the miner")
+	}
+	reward := subsidy
+	for i, t := range b.transactions[1:] {
+		if t.isCoinbase() {
+			return newValidationError(b.index, b.hash, RuleCoinbase, "transaction %d is a second coinbase", i+1)
+		}
+		reward += t.fee
+	}
+	if coinbase.amount != reward {
+		return newValidationError(b.index, b.hash, RuleCoinbase, "expected a reward of %d, got %d", reward, coinbase.amount)
+	}
+	return nil
+}
+
+// validateTransaction runs the checks of Node.verifyTransaction against the received account state,
+// using confirmed to tell if a transaction hash was already confirmed. Without checkSignature only
+// the hash of the transaction is checked
+func validateTransaction(t *Transaction, state *AccountState, confirmed func(string) bool, checkSignature bool) error {
+	if checkSignature && !t.verifySignature() {
+		return fmt.Errorf("invalid hash or signature")
+	}
+	if !checkSignature && t.hash != t.computeHash() {
+		return fmt.Errorf("invalid hash")
+	}
+	if t.amount <= 0 {
+		return fmt.Errorf("non-positive amount")
+	}
+	if t.fee < 0 {
+		return fmt.Errorf("negative fee")
+	}
+	if nonce := state.nonce(t.senderKey); t.nonce != nonce {
+		return fmt.Errorf("expected nonce %d, got %d", nonce, t.nonce)
+	}
+	// the amount and the fee aren't negative, so comparing against their difference can't overflow
+	if balance := state.balance(t.senderKey); t.amount > balance-t.fee {
+		return fmt.Errorf("sender balance %d can't pay an amount of %d and a fee of %d", balance, t.amount, t.fee)
+	}
+	if confirmed(t.hash) {
+		return fmt.Errorf("transaction already exists")
+	}
+	return nil
+}
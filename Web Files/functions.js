@@ -33,25 +33,52 @@ function genKey() {
 
 function makeTransaction() {
     /*
-    makeTransaction sends a transaction to the node based of the values in the texts boxes
+    makeTransaction asks the node for the next nonce of the public key and sends a transaction
+    to the node based of the values in the texts boxes
+    */
+    var pubKey = document.getElementById("PublicKey").value;
+    var xhr = new XMLHttpRequest();
+    xhr.onreadystatechange = function() {
+        if (xhr.readyState == XMLHttpRequest.DONE) {
+            var resp = xhr.response
+            if(!isNaN(resp)) {
+                sendTransaction(resp)
+            } else {
+                alert(resp)
+            }
+        }
+    }
+    xhr.open('GET', '/api/getNonce?pk='+encodeURIComponent(pubKey), true);
+    xhr.send(null);
+}
+
+function sendTransaction(nonce) {
+    /*
+    sendTransaction sends a transaction with the received nonce to the node based of the values
+    in the texts boxes
     */
     var recp = document.getElementById("Recipient").value;
     var amount = document.getElementById("Amount").value;
+    var fee = document.getElementById("Fee").value;
     var privKey = document.getElementById("PrivateKey").value;
     var pubKey = document.getElementById("PublicKey").value;
     var now = new Date();
     var millis = now.getTime();
-    var hash = ec.ECHashString(pubKey + recp + amount + millis);
-    var signature = ec.ECSign(hash, privKey, pubKey);
     var amountInt = Number(amount)
-    if(isNaN(amountInt)) {
+    var feeInt = Number(fee)
+    var nonceInt = Number(nonce)
+    if(isNaN(amountInt) || isNaN(feeInt)) {
         alert("Parameters Error!")
         return
     }
+    var hash = ec.ECHashTransaction(pubKey, recp, amountInt, feeInt, nonceInt, millis);
+    var signature = ec.ECSign(hash, privKey, pubKey);
     var transaction = {
         "senderKey":pubKey,
         "recipientKey":recp,
         "amount":amountInt,
+        "fee":feeInt,
+        "nonce":nonceInt,
         "timestamp":millis,
         "hash":hash,
         "sign":signature,
@@ -75,7 +102,7 @@ function mine() {
     var pubKey = document.getElementById("PublicKey").value;
     var now = new Date();
     var millis = now.getTime();
-    var hash = ec.ECHashString(pubKey + millis);
+    var hash = ec.ECHashOwnerRequest("/api/mineRequest", millis, "");
     var signature = ec.ECSign(hash, privKey, pubKey);
     var mineRequest = {
         "timestamp":millis,
@@ -1,18 +1,48 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"strconv"
+	"sync"
 
 	ec "github.com/IBentu/CryptoCurrency/EClib"
 )
 
 // WebServer is resposible for handling wallet (client) requests in http
 type WebServer struct {
-	server *NodeServer
+	server     *NodeServer
+	httpServer *http.Server
+	cancel     context.CancelFunc
+	done       chan struct{}
+	mutex      *sync.Mutex
+	seen       map[int64]bool // the timestamps of the owner requests within the window
+}
+
+const (
+
+	// OwnerRequestWindow is the maximum number of seconds between the timestamp of an owner request
+	// and the clock of the node
+	OwnerRequestWindow = 30
+	// TransactionAccepted is the answer to a transaction the node added to its TransactionPool
+	TransactionAccepted = "Transaction Accepted."
+)
+
+// ChainInfo is a summary of the blockchain and the node
+type ChainInfo struct {
+	Network    string `json:"network"`
+	Height     int    `json:"height"`
+	Tip        string `json:"tip"`
+	Work       string `json:"work"`
+	Difficulty int    `json:"difficulty"`
+	Supply     int    `json:"supply"`
+	Pruned     int    `json:"pruned"`
+	Peers      int    `json:"peers"`
+	Mining     bool   `json:"mining"`
 }
 
 // handlerSendTransaction gets the transaction of the web client, verifies it and add
@@ -20,37 +50,187 @@ type WebServer struct {
 func (ws *WebServer) handlerSendTransaction(w http.ResponseWriter, r *http.Request) {
 	body, err1 := ioutil.ReadAll(r.Body)
 	trx, err2 := UnformatTransaction(body)
-	if err1 == nil && err2 == nil && ws.server.node.verifyTransaction(trx) {
-		ws.server.node.transactionPool.addTransaction(trx)
-		w.Write([]byte("Transaction Accepted."))
-	} else {
+	if err1 != nil || err2 != nil {
 		w.Write([]byte("Transaction Rejected."))
+		return
+	}
+	if err := ws.server.node.verifyTransaction(trx); err != nil {
+		w.Write([]byte(fmt.Sprintf("Transaction Rejected: %s.", err)))
+		return
+	}
+	ws.server.node.transactionPool.addTransaction(trx)
+	w.Write([]byte(TransactionAccepted))
+}
+
+// ownerRequest is a request only the owner of the node may make. It is signed by the key of the
+// node over the endpoint it is sent to, the timestamp and the peer (see ec.ECHashOwnerRequest), and
+// is accepted once
+type ownerRequest struct {
+	Timestamp int64  `json:"timestamp"`
+	Sign      string `json:"sign"`
+	Peer      string `json:"peer,omitempty"`
+}
+
+// readOwnerRequest reads an ownerRequest from the web client and verifies its signature over the
+// endpoint of r, and that it is recent and wasn't sent before. It writes the answer to a request that
+// is malformed or isn't the owner's and returns nil
+func (ws *WebServer) readOwnerRequest(w http.ResponseWriter, r *http.Request) *ownerRequest {
+	body, err1 := ioutil.ReadAll(r.Body)
+	req := &ownerRequest{}
+	err2 := json.Unmarshal(body, req)
+	if err1 != nil || err2 != nil {
+		w.Write([]byte("Something went wrong."))
+		return nil
+	}
+	hash := ec.ECHashOwnerRequest(r.URL.Path, req.Timestamp, req.Peer)
+	if !ec.ECVerify(hash, req.Sign, ws.server.node.pubKey) {
+		w.Write([]byte("Unautherized request."))
+		return nil
 	}
+	if !ws.checkOwnerTimestamp(req.Timestamp) {
+		w.Write([]byte("Expired or repeated request."))
+		return nil
+	}
+	return req
+}
+
+// checkOwnerTimestamp checks that the timestamp of a signed owner request is within the window of
+// the local clock and wasn't used by another request, and records it
+func (ws *WebServer) checkOwnerTimestamp(timestamp int64) bool {
+	now := GetCurrentMillis()
+	window := int64(OwnerRequestWindow * 1000)
+	if timestamp < now-window || timestamp > now+window {
+		return false
+	}
+	ws.mutex.Lock()
+	defer ws.mutex.Unlock()
+	for t := range ws.seen {
+		if t < now-window {
+			delete(ws.seen, t)
+		}
+	}
+	if ws.seen[timestamp] {
+		return false
+	}
+	ws.seen[timestamp] = true
+	return true
 }
 
 // handlerMine gets the mine request from the web client, verifies the signature
 // and mine a block
 func (ws *WebServer) handlerMine(w http.ResponseWriter, r *http.Request) {
-	body, err1 := ioutil.ReadAll(r.Body)
-	mineReq := &struct {
-		Timestamp int64  `json:"timestamp"`
-		Sign      string `json:"sign"`
-	}{}
-	err2 := json.Unmarshal(body, &mineReq)
-	if err1 == nil && err2 == nil {
-		hash := ec.ECHashString(fmt.Sprintf("%s%d", ws.server.node.pubKey, mineReq.Timestamp))
-		if ec.ECVerify(hash, mineReq.Sign, ws.server.node.pubKey) {
-			if ws.server.node.mine() {
-				w.Write([]byte("Mined Successfully."))
-			} else {
-				w.Write([]byte("Could not mine."))
-			}
-		} else {
-			w.Write([]byte("Unautherized request."))
-		}
+	if ws.readOwnerRequest(w, r) == nil {
+		return
+	}
+	if ws.server.node.mine() {
+		w.Write([]byte("Mined Successfully."))
 	} else {
+		w.Write([]byte("Could not mine."))
+	}
+}
+
+// handlerStartMining gets a request of the owner to mine blocks one after another
+func (ws *WebServer) handlerStartMining(w http.ResponseWriter, r *http.Request) {
+	if ws.readOwnerRequest(w, r) == nil {
+		return
+	}
+	if ws.server.node.startMining() {
+		w.Write([]byte("Started Mining."))
+	} else {
+		w.Write([]byte("Already Mining."))
+	}
+}
+
+// handlerStopMining gets a request of the owner to stop mining after the current block
+func (ws *WebServer) handlerStopMining(w http.ResponseWriter, r *http.Request) {
+	if ws.readOwnerRequest(w, r) == nil {
+		return
+	}
+	if ws.server.node.stopMining() {
+		w.Write([]byte("Stopped Mining."))
+	} else {
+		w.Write([]byte("Not Mining."))
+	}
+}
+
+// handlerGetPeers sends the peers of the node to the web client
+func (ws *WebServer) handlerGetPeers(w http.ResponseWriter, r *http.Request) {
+	data, err := json.Marshal(ws.server.Peers())
+	if err != nil {
+		w.Write([]byte("Something went wrong."))
+		return
+	}
+	w.Write(data)
+}
+
+// handlerAddPeer gets a request of the owner to add a peer
+func (ws *WebServer) handlerAddPeer(w http.ResponseWriter, r *http.Request) {
+	req := ws.readOwnerRequest(w, r)
+	if req == nil {
+		return
+	}
+	if req.Peer == "" {
+		w.Write([]byte("Invalid Peer"))
+		return
+	}
+	ws.server.addPeer(req.Peer)
+	w.Write([]byte("Peer Added."))
+}
+
+// handlerRemovePeer gets a request of the owner to remove a peer
+func (ws *WebServer) handlerRemovePeer(w http.ResponseWriter, r *http.Request) {
+	req := ws.readOwnerRequest(w, r)
+	if req == nil {
+		return
+	}
+	removed, err := ws.server.removePeer(req.Peer)
+	if err != nil {
+		w.Write([]byte(fmt.Sprintf("Peer Removed, could not save the config: %s", err)))
+	} else if removed {
+		w.Write([]byte("Peer Removed."))
+	} else {
+		w.Write([]byte("Peer Not Found"))
+	}
+}
+
+// handlerGetChainInfo sends a summary of the blockchain and the node to the web client
+func (ws *WebServer) handlerGetChainInfo(w http.ResponseWriter, r *http.Request) {
+	bc := ws.server.node.blockchain
+	index := bc.GetLatestIndex()
+	supply, _ := bc.GetSupply(index)
+	data, err := json.Marshal(&ChainInfo{
+		Network:    ws.server.network.Name(),
+		Height:     index,
+		Tip:        bc.GetLatestHash(),
+		Work:       bc.TotalWork().String(),
+		Difficulty: bc.NextDifficulty(),
+		Supply:     supply,
+		Pruned:     bc.Pruned(),
+		Peers:      len(ws.server.Peers()),
+		Mining:     ws.server.node.isMining(),
+	})
+	if err != nil {
 		w.Write([]byte("Something went wrong."))
+		return
 	}
+	w.Write(data)
+}
+
+// handlerVerifyChain gets a request of the owner to validate every block of the blockchain and
+// check its account state
+func (ws *WebServer) handlerVerifyChain(w http.ResponseWriter, r *http.Request) {
+	if ws.readOwnerRequest(w, r) == nil {
+		return
+	}
+	if err := ws.server.node.blockchain.ValidateChain(); err != nil {
+		w.Write([]byte(fmt.Sprintf("Invalid Blockchain: %s", err)))
+		return
+	}
+	if err := ws.server.node.blockchain.CheckState(); err != nil {
+		w.Write([]byte(fmt.Sprintf("Invalid Account State: %s", err)))
+		return
+	}
+	w.Write([]byte("Valid Blockchain."))
 }
 
 // handlerGetBalance gets the public key from the web client checks the balance and sends the
@@ -67,6 +247,129 @@ func (ws *WebServer) handlerGetBalance(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("Invalid Public Key"))
 }
 
+// handlerGetHistory gets a public key and a page from the web client and sends back a page of the
+// changes to the balance of the public key
+func (ws *WebServer) handlerGetHistory(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	pk := query.Get("pk")
+	page, err1 := strconv.Atoi(query.Get("page"))
+	limit, err2 := strconv.Atoi(query.Get("limit"))
+	if len(pk) == 0 || err1 != nil || err2 != nil {
+		w.Write([]byte("Invalid Request"))
+		return
+	}
+	entries, total := ws.server.node.blockchain.GetAddressHistory(pk, page, limit)
+	data, err := json.Marshal(&struct {
+		Entries []AddressEntry `json:"entries"`
+		Total   int            `json:"total"`
+	}{entries, total})
+	if err != nil {
+		w.Write([]byte("Something went wrong."))
+		return
+	}
+	w.Write(data)
+}
+
+// handlerGetTransaction gets a transaction hash from the web client and sends back the transaction,
+// where it was confirmed and its number of confirmations
+func (ws *WebServer) handlerGetTransaction(w http.ResponseWriter, r *http.Request) {
+	hash := r.URL.Query().Get("hash")
+	t, loc, confirmations, err := ws.server.node.blockchain.GetTransaction(hash)
+	if err != nil {
+		w.Write([]byte("Transaction Not Found"))
+		return
+	}
+	data, err := json.Marshal(&struct {
+		Transaction   *Transaction `json:"transaction"`
+		BlockIndex    int          `json:"blockIndex"`
+		Position      int          `json:"position"`
+		Confirmations int          `json:"confirmations"`
+	}{t, loc.BlockIndex, loc.Position, confirmations})
+	if err != nil {
+		w.Write([]byte("Something went wrong."))
+		return
+	}
+	w.Write(data)
+}
+
+// handlerGetMerkleProof gets a transaction hash from the web client and sends back a proof that
+// the transaction is included in its block
+func (ws *WebServer) handlerGetMerkleProof(w http.ResponseWriter, r *http.Request) {
+	proof, err := ws.server.node.blockchain.GetMerkleProof(r.URL.Query().Get("hash"))
+	if err != nil {
+		w.Write([]byte("Transaction Not Found"))
+		return
+	}
+	data, err := json.Marshal(proof)
+	if err != nil {
+		w.Write([]byte("Something went wrong."))
+		return
+	}
+	w.Write(data)
+}
+
+// handlerVerifyMerkleProof gets a Merkle proof from the web client and checks it against the
+// block it names
+func (ws *WebServer) handlerVerifyMerkleProof(w http.ResponseWriter, r *http.Request) {
+	body, err1 := ioutil.ReadAll(r.Body)
+	proof := &MerkleProof{}
+	err2 := json.Unmarshal(body, proof)
+	if err1 != nil || err2 != nil {
+		w.Write([]byte("Something went wrong."))
+		return
+	}
+	valid, err := ws.server.node.blockchain.VerifyMerkleProof(proof)
+	if err != nil {
+		w.Write([]byte("Block Not Found"))
+	} else if valid {
+		w.Write([]byte("Valid Proof."))
+	} else {
+		w.Write([]byte("Invalid Proof."))
+	}
+}
+
+// handlerGetSupply gets an index from the web client (the top of the blockchain by default) and
+// sends back the number of coins in circulation at that index
+func (ws *WebServer) handlerGetSupply(w http.ResponseWriter, r *http.Request) {
+	index := ws.server.node.blockchain.GetLatestIndex()
+	if str := r.URL.Query().Get("index"); len(str) > 0 {
+		var err error
+		if index, err = strconv.Atoi(str); err != nil {
+			w.Write([]byte("Invalid Index"))
+			return
+		}
+	}
+	supply, err := ws.server.node.blockchain.GetSupply(index)
+	if err != nil {
+		w.Write([]byte("Invalid Index"))
+		return
+	}
+	w.Write([]byte(strconv.Itoa(supply)))
+}
+
+// handlerGetOrphans sends the orphaned branches of the blockchain to the web client
+func (ws *WebServer) handlerGetOrphans(w http.ResponseWriter, r *http.Request) {
+	data, err := json.Marshal(ws.server.node.blockchain.GetOrphanedBranches())
+	if err != nil {
+		w.Write([]byte("Something went wrong."))
+		return
+	}
+	w.Write(data)
+}
+
+// handlerGetNonce gets the public key from the web client and sends back the nonce its next
+// transaction must have
+func (ws *WebServer) handlerGetNonce(w http.ResponseWriter, r *http.Request) {
+	pk := r.URL.Query().Get("pk")
+	if len(pk) > 0 {
+		if pk[len(pk)-1] == byte('=') && len(pk) == 88 {
+			w.Write([]byte(strconv.Itoa(ws.server.node.nextNonce(pk))))
+			return
+		}
+	}
+	w.Write([]byte("Invalid Public Key"))
+}
+
 // handlerWallet sends the wallet.html file to the web client
 func handlerWallet(w http.ResponseWriter, r *http.Request) {
 	http.ServeFile(w, r, "Web Files/wallet.html")
@@ -92,15 +395,55 @@ func handlerStyles(w http.ResponseWriter, r *http.Request) {
 	http.ServeFile(w, r, "Web Files/styles.css")
 }
 
-// Start initiates the webServer. run with a goroutine
-func (ws *WebServer) Start() {
-	http.HandleFunc("/static/functions.js", handlerFunctions)
-	http.HandleFunc("/static/eclib.js", handlerEclib)
-	http.HandleFunc("/static/styles.css", handlerStyles)
-	http.HandleFunc("/wallet", handlerWallet)
-	http.HandleFunc("/node", handlerNode)
-	http.HandleFunc("/api/sendTransaction", ws.handlerSendTransaction)
-	http.HandleFunc("/api/mineRequest", ws.handlerMine)
-	http.HandleFunc("/api/getBalance", ws.handlerGetBalance)
-	http.ListenAndServe(fmt.Sprintf(":%d", ListenPort+1), nil)
+// Start runs the webServer on the HTTP port of its NodeServer in a goroutine until ctx is done or
+// Stop is called. It has its own ServeMux, so several can run in one process
+func (ws *WebServer) Start(ctx context.Context) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/static/functions.js", handlerFunctions)
+	mux.HandleFunc("/static/eclib.js", handlerEclib)
+	mux.HandleFunc("/static/styles.css", handlerStyles)
+	mux.HandleFunc("/wallet", handlerWallet)
+	mux.HandleFunc("/node", handlerNode)
+	mux.HandleFunc("/api/sendTransaction", ws.handlerSendTransaction)
+	mux.HandleFunc("/api/mineRequest", ws.handlerMine)
+	mux.HandleFunc("/api/getBalance", ws.handlerGetBalance)
+	mux.HandleFunc("/api/getNonce", ws.handlerGetNonce)
+	mux.HandleFunc("/api/getOrphans", ws.handlerGetOrphans)
+	mux.HandleFunc("/api/getSupply", ws.handlerGetSupply)
+	mux.HandleFunc("/api/getTransaction", ws.handlerGetTransaction)
+	mux.HandleFunc("/api/getHistory", ws.handlerGetHistory)
+	mux.HandleFunc("/api/getMerkleProof", ws.handlerGetMerkleProof)
+	mux.HandleFunc("/api/verifyMerkleProof", ws.handlerVerifyMerkleProof)
+	mux.HandleFunc("/api/startMining", ws.handlerStartMining)
+	mux.HandleFunc("/api/stopMining", ws.handlerStopMining)
+	mux.HandleFunc("/api/getPeers", ws.handlerGetPeers)
+	mux.HandleFunc("/api/addPeer", ws.handlerAddPeer)
+	mux.HandleFunc("/api/removePeer", ws.handlerRemovePeer)
+	mux.HandleFunc("/api/getChainInfo", ws.handlerGetChainInfo)
+	mux.HandleFunc("/api/verifyChain", ws.handlerVerifyChain)
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", ws.server.httpPort))
+	if err != nil {
+		return err
+	}
+	ws.httpServer = &http.Server{Handler: mux}
+	ctx, ws.cancel = context.WithCancel(ctx)
+	ws.done = make(chan struct{})
+	go func() {
+		if err := ws.httpServer.Serve(ln); err != http.ErrServerClosed {
+			fmt.Printf("The web server stopped: %s\n", err)
+		}
+	}()
+	// the requests being handled, such as a block being mined, are finished before it stops
+	go func() {
+		<-ctx.Done()
+		ws.httpServer.Shutdown(context.Background())
+		close(ws.done)
+	}()
+	return nil
+}
+
+// Stop stops accepting requests and waits for the requests being handled
+func (ws *WebServer) Stop() {
+	ws.cancel()
+	<-ws.done
 }
@@ -2,23 +2,39 @@ package main
 
 import (
 	"bytes"
+	"math/big"
 	"strconv"
 )
 
-// FormatSCM formats the th received hash and index to bytes
-func FormatSCM(index int, hash string) []byte {
-	str := strconv.Itoa(index) + "\000" + hash
+// FormatSCM formats the th received hash, index, cumulative work and the index of the lowest block
+// the node serves the body of to bytes
+func FormatSCM(index int, hash string, work *big.Int, pruned int) []byte {
+	str := strconv.Itoa(index) + "\000" + hash + "\000" + work.String() + "\000" + strconv.Itoa(pruned)
 	return []byte(str)
 }
 
-// UnformatSCM unformats the received bytes back to hash and index
-func UnformatSCM(data []byte) (int, string, error) {
+// UnformatSCM unformats the received bytes back to hash, index, cumulative work and the index of
+// the lowest block the node serves the body of, which is 0 for a node that doesn't send it
+func UnformatSCM(data []byte) (int, string, *big.Int, int, error) {
 	splat := bytes.Split(data, []byte("\000"))
+	if len(splat) != 3 && len(splat) != 4 {
+		return 0, "", nil, 0, ErrPacketType
+	}
 	index, err := strconv.Atoi(string(splat[0]))
 	if err != nil {
-		return 0, "", err
+		return 0, "", nil, 0, err
+	}
+	work, ok := new(big.Int).SetString(string(splat[2]), 10)
+	if !ok {
+		return 0, "", nil, 0, ErrPacketType
 	}
-	return index, string(splat[1]), nil
+	pruned := 0
+	if len(splat) == 4 {
+		if pruned, err = strconv.Atoi(string(splat[3])); err != nil {
+			return 0, "", nil, 0, err
+		}
+	}
+	return index, string(splat[1]), work, pruned, nil
 }
 
 // FormatFT formats n to bytes
@@ -49,6 +65,71 @@ func UnformatIS(data []byte) (int, error) {
 	return index, nil
 }
 
+// FormatHR formats the first index and the number of headers to bytes
+func FormatHR(index, count int) []byte {
+	return []byte(strconv.Itoa(index) + "\000" + strconv.Itoa(count))
+}
+
+// UnformatHR formats bytes to the first index and the number of headers
+func UnformatHR(data []byte) (int, int, error) {
+	return unformatRange(data)
+}
+
+// FormatBRR formats the first index and the number of blocks to bytes
+func FormatBRR(index, count int) []byte {
+	return []byte(strconv.Itoa(index) + "\000" + strconv.Itoa(count))
+}
+
+// UnformatBRR formats bytes to the first index and the number of blocks
+func UnformatBRR(data []byte) (int, int, error) {
+	return unformatRange(data)
+}
+
+// unformatRange formats bytes to a first index and a count
+func unformatRange(data []byte) (int, int, error) {
+	splat := bytes.Split(data, []byte("\000"))
+	if len(splat) != 2 {
+		return 0, 0, ErrPacketType
+	}
+	index, err := strconv.Atoi(string(splat[0]))
+	if err != nil {
+		return 0, 0, err
+	}
+	count, err := strconv.Atoi(string(splat[1]))
+	if err != nil {
+		return 0, 0, err
+	}
+	return index, count, nil
+}
+
+// FormatHP formats headers array to byte array
+func FormatHP(headers []*BlockHeader) []byte {
+	var data []byte
+	for _, v := range headers {
+		bytes, err := v.MarshalJSON()
+		if err != nil {
+			continue
+		}
+		data = append(append(data, bytes...), []byte("|\000")...)
+	}
+	return data
+}
+
+// UnformatHP formats byte array to headers array
+func UnformatHP(data []byte) ([]*BlockHeader, error) {
+	splat := bytes.Split(data, []byte("|\000"))
+	headers := make([]*BlockHeader, 0)
+	for _, v := range splat {
+		h := &BlockHeader{}
+		err := h.UnmarshalJSON(v)
+		if err != nil {
+			continue
+		}
+		headers = append(headers, h)
+	}
+	return headers, nil
+}
+
 // FormatBP formats blocks array to byte array
 func FormatBP(blocks []*Block) []byte {
 	var data []byte
@@ -1,6 +1,11 @@
 package main
 
 import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
 	"time"
 )
 
@@ -16,3 +21,55 @@ func Abs(value int) int {
 func GetCurrentMillis() int64 {
 	return time.Now().UnixNano() / int64(time.Millisecond)
 }
+
+// writeFileAtomic writes data to a temporary file next to file, syncs it and renames it over file,
+// so after a crash file holds either its old or its new content
+func writeFileAtomic(file string, data []byte) error {
+	tmp, err := ioutil.TempFile(path.Dir(file), path.Base(file)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Chmod(0644)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), file)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return syncDir(path.Dir(file))
+}
+
+// syncDir syncs a directory, so the files created, renamed or removed in it survive a crash
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// lockDataDir takes an exclusive lock on the LOCK file of a data directory, so a running node and
+// the commands that open its blockchain can't use it at the same time. Closing the returned file
+// releases the lock, and the system releases it when the process exits
+func lockDataDir(dataDir string) (*os.File, error) {
+	file, err := os.OpenFile(path.Join(dataDir, "LOCK"), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%s is in use by another node or command", dataDir)
+	}
+	return file, nil
+}